@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// apartmentPatchField описывает, как поле из JSON Merge Patch попадает в колонку.
+// parse получает сырое значение (null уже обработан) и возвращает значение для SQL.
+type apartmentPatchField struct {
+	column   string
+	nullable bool // null очищает поле вместо ошибки
+	empty    any  // чем заменяется null для nullable-полей
+	parse    func(raw json.RawMessage) (any, string)
+}
+
+func parseNonEmptyString(maxLen int) func(json.RawMessage) (any, string) {
+	return func(raw json.RawMessage) (any, string) {
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, "должно быть строкой"
+		}
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return nil, "не может быть пустым"
+		}
+		if len([]rune(v)) > maxLen {
+			return nil, fmt.Sprintf("не длиннее %d символов", maxLen)
+		}
+		return v, ""
+	}
+}
+
+func parseString(maxLen int) func(json.RawMessage) (any, string) {
+	return func(raw json.RawMessage) (any, string) {
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, "должно быть строкой"
+		}
+		if len([]rune(v)) > maxLen {
+			return nil, fmt.Sprintf("не длиннее %d символов", maxLen)
+		}
+		return v, ""
+	}
+}
+
+func parseIntAtLeast(min int) func(json.RawMessage) (any, string) {
+	return func(raw json.RawMessage) (any, string) {
+		var v int
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, "должно быть целым числом"
+		}
+		if v < min {
+			return nil, fmt.Sprintf("не может быть меньше %d", min)
+		}
+		return v, ""
+	}
+}
+
+func parsePrice(raw json.RawMessage) (any, string) {
+	var v float64
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, "должно быть числом"
+	}
+	if v < 0 {
+		return nil, "не может быть отрицательной"
+	}
+	return v, ""
+}
+
+func parseBool(raw json.RawMessage) (any, string) {
+	var v bool
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, "должно быть true или false"
+	}
+	return v, ""
+}
+
+var apartmentPatchFields = map[string]apartmentPatchField{
+	"title":         {column: "title", parse: parseNonEmptyString(200)},
+	"address":       {column: "address", parse: parseNonEmptyString(500)},
+	"image_link":    {column: "image_link", nullable: true, empty: "", parse: parseString(2000)},
+	"description":   {column: "description", nullable: true, empty: "", parse: parseString(10000)},
+	"square_meters": {column: "square_meters", parse: parseIntAtLeast(1)},
+	"bedrooms":      {column: "bedrooms", parse: parseIntAtLeast(0)},
+	"price":         {column: "price", parse: parsePrice},
+	"favourite":     {column: "favourite", parse: parseBool},
+	// host_id через патч не меняется: хозяин получает чаты и события по квартире,
+	// поэтому его назначает только администратор (PUT /admin/apartments/:id/host)
+}
+
+// buildApartmentPatch разбирает тело JSON Merge Patch (RFC 7396) и возвращает
+// SET-выражения с аргументами. Отсутствующие поля не трогаются,
+// null очищает необязательные поля, нули и false сохраняются как есть.
+func buildApartmentPatch(body []byte) (sets []string, args []any, fieldErrors map[string]string, err error) {
+	var patch map[string]json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&patch); err != nil {
+		return nil, nil, nil, err
+	}
+	if patch == nil {
+		return nil, nil, nil, fmt.Errorf("тело патча должно быть JSON-объектом")
+	}
+
+	fieldErrors = map[string]string{}
+	for name, raw := range patch {
+		field, ok := apartmentPatchFields[name]
+		if !ok {
+			if name == "id" {
+				fieldErrors[name] = "не может быть изменен"
+			} else {
+				fieldErrors[name] = "неизвестное поле"
+			}
+			continue
+		}
+
+		var value any
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			if !field.nullable {
+				fieldErrors[name] = "не может быть null"
+				continue
+			}
+			value = field.empty
+		} else {
+			var msg string
+			value, msg = field.parse(raw)
+			if msg != "" {
+				fieldErrors[name] = msg
+				continue
+			}
+		}
+
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", field.column, len(args)))
+	}
+
+	return sets, args, fieldErrors, nil
+}
+
+// PATCH /apartments/:id с семантикой JSON Merge Patch. Менять квартиру может ее хозяин или администратор.
+func patchApartmentHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Не удалось прочитать тело запроса"})
+		return
+	}
+
+	sets, args, fieldErrors, err := buildApartmentPatch(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Ошибка валидации", "fields": fieldErrors})
+		return
+	}
+
+	versions := ifMatchVersions(c)
+	var apartment Apartment
+	if len(sets) == 0 {
+		// Пустой патч ничего не меняет, но ответ должен быть тем же ресурсом
+		row := db.QueryRow(`
+			SELECT `+apartmentColumns+` FROM apartments
+			WHERE id = $1 AND deleted_at IS NULL
+			  AND ($2::bigint[] IS NULL OR version = ANY($2::bigint[]))
+		`, id, pq.Array(versions))
+		err = scanApartment(row, &apartment)
+		if err == nil && !canManageApartment(c, apartment.HostID) {
+			err = errApartmentNotOwned
+		}
+	} else {
+		args = append(args, id, pq.Array(versions))
+		query := fmt.Sprintf(`
+			UPDATE apartments
+			SET %s, version = version + 1
+			WHERE id = $%d AND deleted_at IS NULL
+			  AND ($%d::bigint[] IS NULL OR version = ANY($%d::bigint[]))
+			RETURNING %s
+		`, strings.Join(sets, ", "), len(args)-1, len(args), len(args), apartmentColumns)
+		var changed *Apartment
+		changed, err = changeOwnApartment(c, id, revisionUpdate, func(tx *sql.Tx) (*Apartment, error) {
+			var a Apartment
+			err := scanApartment(tx.QueryRow(query, args...), &a)
+			return &a, err
+		})
+		if err == nil {
+			apartment = *changed
+		}
+	}
+	if err == sql.ErrNoRows {
+		respondApartmentMiss(c, id, versions)
+		return
+	} else if err == errApartmentNotOwned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка при обновлении квартиры:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении данных"})
+		return
+	}
+
+	c.Header("ETag", versionETag(apartment.Version))
+	c.JSON(http.StatusOK, apartment)
+}
+
+// PUT /admin/apartments/:id/host — назначить хозяина квартиры или снять его ("host_id": null)
+func setApartmentHostHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	}
+	var request struct {
+		HostID *string `json:"host_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	if request.HostID != nil {
+		if _, err := uuid.Parse(*request.HostID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный host_id"})
+			return
+		}
+	}
+
+	versions := ifMatchVersions(c)
+	apartment, err := changeApartment(id, revisionUpdate, currentUserID(c), nil, func(tx *sql.Tx) (*Apartment, error) {
+		var a Apartment
+		err := scanApartment(tx.QueryRow(`
+			UPDATE apartments
+			SET host_id = $1, version = version + 1
+			WHERE id = $2 AND deleted_at IS NULL
+			  AND ($3::bigint[] IS NULL OR version = ANY($3::bigint[]))
+			RETURNING `+apartmentColumns,
+			request.HostID, id, pq.Array(versions)), &a)
+		return &a, err
+	})
+	if err == sql.ErrNoRows {
+		respondApartmentMiss(c, id, versions)
+		return
+	} else if err != nil {
+		log.Println("Ошибка назначения хозяина квартиры:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении данных"})
+		return
+	}
+
+	c.Header("ETag", versionETag(apartment.Version))
+	c.JSON(http.StatusOK, apartment)
+}
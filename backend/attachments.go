@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	maxAttachmentSize        = 10 << 20
+	maxAttachmentsPerMessage = 10
+	// Больше пикселей не распаковываем, чтобы маленький файл не съел всю память
+	maxImagePixels = 40_000_000
+	thumbnailSize  = 320
+
+	attachmentURLTTL = 15 * time.Minute
+	// Загруженные, но так и не отправленные вложения удаляются через сутки
+	unsentAttachmentRetention = 24 * time.Hour
+)
+
+// Какие файлы можно прикладывать. Тип определяется по содержимому, а не по заголовку клиента.
+var attachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+var storage Storage
+
+// Ссылки на файлы подписываются отдельным секретом, а если он не задан — секретом токенов.
+// Если нет ни того, ни другого, вложения отключены
+var attachmentURLSecret []byte
+
+func attachmentSigningKey() []byte {
+	if len(attachmentURLSecret) > 0 {
+		return attachmentURLSecret
+	}
+	return jwtSecret
+}
+
+// Attachment — файл, приложенный к сообщению. URL и ThumbnailURL действуют до ExpiresAt.
+type Attachment struct {
+	ID           string    `json:"id"`
+	FileName     string    `json:"file_name"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	Width        *int      `json:"width,omitempty"`
+	Height       *int      `json:"height,omitempty"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+
+	hasThumbnail bool
+}
+
+const attachmentColumns = "id, file_name, content_type, size_bytes, width, height, thumbnail_key IS NOT NULL"
+
+// scanAttachment читает вложение; extra — колонки, выбранные после attachmentColumns.
+func scanAttachment(row rowScanner, a *Attachment, extra ...any) error {
+	var width, height sql.NullInt64
+	dest := append([]any{&a.ID, &a.FileName, &a.ContentType, &a.Size, &width, &height, &a.hasThumbnail}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	if width.Valid && height.Valid {
+		w, h := int(width.Int64), int(height.Int64)
+		a.Width, a.Height = &w, &h
+	}
+	return nil
+}
+
+func attachmentSignature(id, variant string, expires int64) string {
+	mac := hmac.New(sha256.New, attachmentSigningKey())
+	fmt.Fprintf(mac, "%s\n%s\n%d", id, variant, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedAttachmentURL(id, variant string, expires int64) string {
+	q := url.Values{}
+	if variant != "" {
+		q.Set("variant", variant)
+	}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("signature", attachmentSignature(id, variant, expires))
+	return "/attachments/" + id + "?" + q.Encode()
+}
+
+// sign выдает вложению свежие ссылки для скачивания.
+func (a *Attachment) sign() {
+	a.ExpiresAt = time.Now().Add(attachmentURLTTL).Truncate(time.Second)
+	expires := a.ExpiresAt.Unix()
+	a.URL = signedAttachmentURL(a.ID, "", expires)
+	if a.hasThumbnail {
+		a.ThumbnailURL = signedAttachmentURL(a.ID, "thumb", expires)
+	}
+}
+
+var errAttachmentNotFound = errors.New("вложение не найдено или уже отправлено")
+
+// linkAttachments привязывает загруженные отправителем в этот чат вложения к сообщению.
+func linkAttachments(tx *sql.Tx, messageID, chatID, senderID string, ids []string) ([]Attachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, errAttachmentNotFound
+		}
+	}
+
+	rows, err := tx.Query(`
+		UPDATE message_attachments SET message_id = $1
+		WHERE id = ANY($2::uuid[]) AND chat_id = $3 AND uploader_id = $4 AND message_id IS NULL
+		RETURNING `+attachmentColumns,
+		messageID, pq.Array(ids), chatID, senderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := map[string]Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, err
+		}
+		a.sign()
+		byID[a.ID] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Порядок вложений — тот, в котором их прислал клиент
+	attachments := make([]Attachment, 0, len(ids))
+	for _, id := range ids {
+		a, ok := byID[id]
+		if !ok {
+			return nil, errAttachmentNotFound
+		}
+		attachments = append(attachments, a)
+		delete(byID, id)
+	}
+	return attachments, nil
+}
+
+// attachAttachments дополняет сообщения вложениями со свежими ссылками.
+// У удаленных для всех сообщений вложения не показываются.
+func attachAttachments(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+
+	rows, err := db.Query(`
+		SELECT `+attachmentColumns+`, message_id
+		FROM message_attachments
+		WHERE message_id = ANY($1::uuid[])
+		ORDER BY created_at, id
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	attachments := map[string][]Attachment{}
+	for rows.Next() {
+		var messageID string
+		var a Attachment
+		if err := scanAttachment(rows, &a, &messageID); err != nil {
+			return err
+		}
+		a.sign()
+		attachments[messageID] = append(attachments[messageID], a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range messages {
+		if messages[i].DeletedAt == nil {
+			messages[i].Attachments = attachments[messages[i].ID]
+		}
+	}
+	return nil
+}
+
+// POST /chats/:chat_id/attachments — загрузить файл (поле file) для следующего сообщения.
+// Возвращает id, который передается в attachment_ids при отправке сообщения.
+func uploadAttachmentHandler(c *gin.Context) {
+	chatID := c.Param("chat_id")
+	userID := currentUserID(c)
+
+	if _, err := uuid.Parse(chatID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return
+	}
+	member, err := isChatMember(db, chatID, userID)
+	if err != nil {
+		log.Println("Ошибка проверки чата:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка загрузки файла"})
+		return
+	}
+	if !member {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return
+	}
+
+	// Запас на заголовки multipart сверх размера самого файла
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Файл больше %d МБ", maxAttachmentSize>>20)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Нужно передать файл в поле file"})
+		return
+	}
+	if header.Size > maxAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Файл больше %d МБ", maxAttachmentSize>>20)})
+		return
+	}
+	if header.Size == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Файл пустой"})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Не удалось прочитать файл"})
+		return
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if !attachmentTypes[contentType] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Можно прикладывать только изображения JPEG, PNG, GIF, WebP и документы PDF"})
+		return
+	}
+
+	id := uuid.New().String()
+	key := "attachments/" + chatID + "/" + id
+	var thumbKey sql.NullString
+	var width, height sql.NullInt64
+
+	// Для изображений, которые умеет читать стандартная библиотека, сохраняем размеры и превью
+	if contentType != "image/webp" && strings.HasPrefix(contentType, "image/") {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка загрузки файла"})
+			return
+		}
+		thumb, w, h, err := makeThumbnail(file)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Не удалось прочитать изображение"})
+			return
+		}
+		width = sql.NullInt64{Int64: int64(w), Valid: true}
+		height = sql.NullInt64{Int64: int64(h), Valid: true}
+		if _, err := storage.Put(key+"_thumb", thumb); err != nil {
+			log.Println("Ошибка сохранения превью:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка загрузки файла"})
+			return
+		}
+		thumbKey = sql.NullString{String: key + "_thumb", Valid: true}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка загрузки файла"})
+		return
+	}
+	size, err := storage.Put(key, file)
+	if err != nil {
+		log.Println("Ошибка сохранения файла:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка загрузки файла"})
+		return
+	}
+
+	var attachment Attachment
+	err = scanAttachment(db.QueryRow(`
+		INSERT INTO message_attachments
+			(id, chat_id, uploader_id, file_name, content_type, size_bytes, storage_key, thumbnail_key, width, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING `+attachmentColumns,
+		id, chatID, userID, attachmentFileName(header.Filename), contentType, size, key, thumbKey, width, height), &attachment)
+	if err != nil {
+		log.Println("Ошибка сохранения вложения:", err)
+		storage.Delete(key)
+		if thumbKey.Valid {
+			storage.Delete(thumbKey.String)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка загрузки файла"})
+		return
+	}
+
+	attachment.sign()
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// attachmentFileName оставляет от имени файла клиента только последнюю часть пути.
+func attachmentFileName(name string) string {
+	name = strings.TrimSpace(name[strings.LastIndexAny(name, `/\`)+1:])
+	if name == "" {
+		return "file"
+	}
+	if len([]rune(name)) > 255 {
+		name = string([]rune(name)[:255])
+	}
+	return name
+}
+
+// makeThumbnail уменьшает изображение так, чтобы большая сторона была не больше thumbnailSize,
+// и возвращает превью в JPEG вместе с размерами оригинала.
+func makeThumbnail(r io.ReadSeeker) (io.Reader, int, int, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, 0, 0, errors.New("слишком большое изображение")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, 0, err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(src, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, 0, 0, err
+	}
+	return &buf, config.Width, config.Height, nil
+}
+
+// scaleDown уменьшает изображение усреднением пикселей. Прозрачные области
+// становятся белыми, потому что JPEG не хранит прозрачность.
+func scaleDown(src image.Image, max int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > max || h > max {
+		if w >= h {
+			w, h = max, h*max/w
+		} else {
+			w, h = w*max/h, max
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					white := 0xffff - uint64(ca)
+					r += uint64(cr) + white
+					g += uint64(cg) + white
+					bl += uint64(cb) + white
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: 0xffff})
+		}
+	}
+	return dst
+}
+
+// GET /attachments/:id?variant=thumb&expires=&signature= — скачать файл по подписанной ссылке.
+// Ссылки выдаются только участникам чата и действуют attachmentURLTTL.
+func downloadAttachmentHandler(c *gin.Context) {
+	id := c.Param("id")
+	variant := c.Query("variant")
+
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || (variant != "" && variant != "thumb") || len(attachmentSigningKey()) == 0 ||
+		!hmac.Equal([]byte(c.Query("signature")), []byte(attachmentSignature(id, variant, expires))) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Некорректная ссылка на файл"})
+		return
+	}
+	if time.Now().Unix() > expires {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Срок действия ссылки истек"})
+		return
+	}
+
+	var fileName, contentType, key string
+	var thumbKey sql.NullString
+	var size int64
+	err = db.QueryRow(`
+		SELECT a.file_name, a.content_type, a.size_bytes, a.storage_key, a.thumbnail_key
+		FROM message_attachments a
+		LEFT JOIN messages m ON m.id = a.message_id
+		WHERE a.id = $1 AND m.deleted_at IS NULL
+	`, id).Scan(&fileName, &contentType, &size, &key, &thumbKey)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Файл не найден"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения вложения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения файла"})
+		return
+	}
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	if variant == "thumb" {
+		if !thumbKey.Valid {
+			c.JSON(http.StatusNotFound, gin.H{"error": "У файла нет превью"})
+			return
+		}
+		key, contentType, size, disposition = thumbKey.String, "image/jpeg", -1, "inline"
+	}
+
+	file, err := storage.Open(key)
+	if err != nil {
+		log.Println("Ошибка чтения файла из хранилища:", err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Файл не найден"})
+		return
+	}
+	defer file.Close()
+
+	c.DataFromReader(http.StatusOK, size, contentType, file, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": fileName}),
+		"Cache-Control":          "private, max-age=" + strconv.FormatInt(max(expires-time.Now().Unix(), 0), 10),
+		"X-Content-Type-Options": "nosniff",
+	})
+}
+
+// GET /attachments/:id/link — новые подписанные ссылки взамен истекших.
+func attachmentLinkHandler(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Файл не найден"})
+		return
+	}
+
+	var attachment Attachment
+	err := scanAttachment(db.QueryRow(`
+		SELECT `+attachmentColumns+`
+		FROM message_attachments a
+		WHERE a.id = $1
+		  AND EXISTS (SELECT 1 FROM chat_members cm WHERE cm.chat_id = a.chat_id AND cm.user_id = $2)
+		  AND NOT EXISTS (SELECT 1 FROM messages m WHERE m.id = a.message_id AND m.deleted_at IS NOT NULL)
+		  AND (a.message_id IS NOT NULL OR a.uploader_id = $2)
+	`, id, currentUserID(c)), &attachment)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Файл не найден"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения вложения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения файла"})
+		return
+	}
+
+	attachment.sign()
+	c.JSON(http.StatusOK, attachment)
+}
+
+// cleanupUnsentAttachments удаляет вложения, которые загрузили, но так и не отправили,
+// и возвращает, сколько их было.
+func cleanupUnsentAttachments(retention time.Duration) (int, error) {
+	rows, err := db.Query(`
+		DELETE FROM message_attachments
+		WHERE message_id IS NULL AND created_at < now() - make_interval(secs => $1)
+		RETURNING storage_key, thumbnail_key
+	`, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	var keys []string
+	for rows.Next() {
+		var key string
+		var thumbKey sql.NullString
+		if err := rows.Scan(&key, &thumbKey); err != nil {
+			rows.Close()
+			return removed, err
+		}
+		removed++
+		keys = append(keys, key)
+		if thumbKey.Valid {
+			keys = append(keys, thumbKey.String)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return removed, err
+	}
+
+	// Записи уже удалены, поэтому файл, который не удалось стереть, только логируется
+	for _, key := range keys {
+		if err := storage.Delete(key); err != nil {
+			log.Println("Ошибка удаления файла из хранилища:", err)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Клиент авторизуется через Supabase, поэтому бэкенд принимает его access-токены:
+// JWT, подписанные HS256 секретом проекта. В sub лежит UUID пользователя.
+// Задается из настроек (SUPABASE_JWT_SECRET) при запуске.
+var jwtSecret []byte
+
+type authClaims struct {
+	Subject     string `json:"sub"`
+	ExpiresAt   int64  `json:"exp"`
+	AppMetadata struct {
+		Role string `json:"role"`
+	} `json:"app_metadata"`
+}
+
+var errInvalidToken = errors.New("некорректный токен")
+
+// parseToken проверяет подпись и срок действия токена и возвращает его claims.
+func parseToken(token string) (*authClaims, error) {
+	if len(jwtSecret) == 0 {
+		return nil, errors.New("секрет для проверки токенов не задан")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return nil, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims authClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+	// Токен без exp был бы вечным, такие Supabase не выдает
+	if claims.ExpiresAt == 0 {
+		return nil, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("срок действия токена истек")
+	}
+
+	return &claims, nil
+}
+
+// bearerToken достает токен из заголовка Authorization.
+func bearerToken(c *gin.Context) string {
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return token
+}
+
+// queryToken переносит токен из параметра access_token в заголовок Authorization.
+// WebSocket и EventSource в браузере не умеют ставить заголовки, поэтому
+// middleware ставится только на их маршруты: в остальных токен в адресе
+// оседал бы в истории браузера и логах прокси.
+func queryToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := c.Query("access_token"); token != "" && c.GetHeader("Authorization") == "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+		c.Next()
+	}
+}
+
+// redactAccessToken заменяет значение access_token в пути с запросом, чтобы токен не попал в лог.
+func redactAccessToken(path string) string {
+	base, rawQuery, ok := strings.Cut(path, "?")
+	if !ok {
+		return path
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Непонятный запрос целиком не пишем: в нем может быть токен
+		return base + "?REDACTED"
+	}
+	if !query.Has("access_token") {
+		return path
+	}
+	query.Set("access_token", "REDACTED")
+	return base + "?" + query.Encode()
+}
+
+// accessLogFormatter пишет строку лога запроса как стандартный логгер gin,
+// но без значения access_token.
+func accessLogFormatter(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		redactAccessToken(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+// authRequired пропускает только запросы с действительным Bearer-токеном
+// и сохраняет идентификатор пользователя в контексте.
+func authRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Требуется авторизация"})
+			return
+		}
+
+		claims, err := parseToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Недействительный токен"})
+			return
+		}
+
+		c.Set("user_id", claims.Subject)
+		c.Set("role", claims.AppMetadata.Role)
+		c.Next()
+	}
+}
+
+// authOptional запоминает пользователя, если запрос пришел с действительным токеном,
+// и пропускает анонимные запросы без ошибки.
+func authOptional() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := bearerToken(c); token != "" {
+			if claims, err := parseToken(token); err == nil {
+				c.Set("user_id", claims.Subject)
+				c.Set("role", claims.AppMetadata.Role)
+			}
+		}
+		c.Next()
+	}
+}
+
+// adminRequired должен стоять после authRequired.
+func adminRequired() gin.HandlerFunc {
+	return roleRequired("admin")
+}
+
+// roleRequired пропускает пользователей с одной из ролей. Должен стоять после authRequired.
+func roleRequired(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !slices.Contains(roles, c.GetString("role")) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentUserID возвращает UUID авторизованного пользователя.
+func currentUserID(c *gin.Context) string {
+	return c.GetString("user_id")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func signTestToken(t *testing.T, payload string) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	body := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(header + "." + body))
+	return header + "." + body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Токен из адреса принимают только маршруты с queryToken, остальные требуют заголовок.
+func TestQueryTokenOnlyWhereEnabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	saved := jwtSecret
+	jwtSecret = []byte("test-secret")
+	defer func() { jwtSecret = saved }()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	token := signTestToken(t, `{"sub":"8f0c6a9e-3b1d-4c1e-9a57-1f6c0b2d3e4f","exp":`+strconv.FormatInt(exp, 10)+`}`)
+
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/events", queryToken(), authRequired(), ok)
+	r.GET("/orders", authRequired(), ok)
+
+	for path, want := range map[string]int{
+		"/events?access_token=" + token: http.StatusOK,
+		"/orders?access_token=" + token: http.StatusUnauthorized,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s: статус %d, ожидался %d", strings.SplitN(path, "?", 2)[0], w.Code, want)
+		}
+	}
+}
+
+func TestRedactAccessToken(t *testing.T) {
+	got := redactAccessToken("/events?since=5&access_token=secret")
+	if strings.Contains(got, "secret") || !strings.Contains(got, "since=5") {
+		t.Fatalf("redactAccessToken: %q", got)
+	}
+	if got := redactAccessToken("/apartments?page=2"); got != "/apartments?page=2" {
+		t.Fatalf("запрос без токена изменился: %q", got)
+	}
+}
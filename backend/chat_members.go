@@ -0,0 +1,570 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Виды чатов: личный — ровно два участника, групповой — с названием и администраторами
+const (
+	chatKindDirect = "direct"
+	chatKindGroup  = "group"
+)
+
+// Роли участника группового чата
+const (
+	chatRoleMember = "member"
+	chatRoleAdmin  = "admin"
+)
+
+const (
+	maxGroupMembers     = 50
+	maxGroupTitleLength = 100
+)
+
+// Типы системных сообщений об изменениях группы
+const (
+	systemChatCreated       = "chat.created"
+	systemChatRenamed       = "chat.renamed"
+	systemChatMemberAdded   = "chat.member_added"
+	systemChatMemberLeft    = "chat.member_left"
+	systemChatMemberRemoved = "chat.member_removed"
+	systemChatRoleChanged   = "chat.role_changed"
+)
+
+func validGroupTitle(title string) (string, bool) {
+	title = strings.TrimSpace(title)
+	return title, title != "" && len([]rune(title)) <= maxGroupTitleLength
+}
+
+// parseUserIDs приводит список UUID к единому виду и убирает повторы.
+func parseUserIDs(ids []string) ([]string, error) {
+	seen := map[string]bool{}
+	var result []string
+	for _, id := range ids {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return nil, fmt.Errorf("Некорректный идентификатор пользователя: %q", id)
+		}
+		if !seen[parsed.String()] {
+			seen[parsed.String()] = true
+			result = append(result, parsed.String())
+		}
+	}
+	return result, nil
+}
+
+// displayNames возвращает имена пользователей через запятую для текста системного сообщения.
+func displayNames(ids []string) string {
+	names, err := userNames(ids)
+	if err != nil {
+		log.Println("Ошибка получения имен участников:", err)
+	}
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = names[id]
+		if parts[i] == "" {
+			parts[i] = "Пользователь"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// postChatSystemMessage пишет в чат системное сообщение. extraRecipients получают событие,
+// даже если уже не состоят в чате, — например, исключенный участник.
+func postChatSystemMessage(tx *sql.Tx, chatID, text string, system gin.H, extraRecipients ...string) (postedMessage, error) {
+	message, participants, err := insertMessage(tx, newMessage{
+		ChatID: chatID,
+		Kind:   messageKindSystem,
+		Text:   text,
+		System: system,
+	})
+	if err != nil {
+		return postedMessage{}, err
+	}
+	return postedMessage{message: message, participants: append(participants, extraRecipients...)}, nil
+}
+
+// lockGroupChat блокирует групповой чат до конца транзакции, чтобы изменения состава
+// не пересекались, и возвращает роль пользователя в нем.
+// Если чата нет или пользователь в нем не состоит, возвращается sql.ErrNoRows.
+func lockGroupChat(tx *sql.Tx, chatID, userID string) (kind, role string, err error) {
+	if _, err := uuid.Parse(chatID); err != nil {
+		return "", "", sql.ErrNoRows
+	}
+	if err := tx.QueryRow("SELECT kind FROM chats WHERE id = $1 FOR UPDATE", chatID).Scan(&kind); err != nil {
+		return "", "", err
+	}
+	err = tx.QueryRow("SELECT role FROM chat_members WHERE chat_id = $1 AND user_id = $2", chatID, userID).Scan(&role)
+	return kind, role, err
+}
+
+// membershipRequest — общее начало обработчиков, меняющих групповой чат:
+// транзакция, блокировка чата и проверка, что это группа и пользователь в ней состоит.
+// При ошибке ответ уже отправлен и возвращается nil.
+func membershipRequest(c *gin.Context, chatID, userID string) (*sql.Tx, string) {
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+		return nil, ""
+	}
+
+	kind, role, err := lockGroupChat(tx, chatID, userID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return nil, ""
+	} else if err != nil {
+		tx.Rollback()
+		log.Println("Ошибка получения чата:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+		return nil, ""
+	}
+	if kind != chatKindGroup {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Состав можно менять только у группового чата"})
+		return nil, ""
+	}
+	return tx, role
+}
+
+// commitAndPublish фиксирует изменения и рассылает системные сообщения.
+func commitAndPublish(c *gin.Context, tx *sql.Tx, posted ...postedMessage) bool {
+	if err := tx.Commit(); err != nil {
+		log.Println("Ошибка изменения чата:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+		return false
+	}
+	for _, p := range posted {
+		publishEvent(eventMessageCreated, p.message.ChatID, p.message, p.participants)
+	}
+	return true
+}
+
+// addChatMembers добавляет пользователей в чат и возвращает тех, кого в нем еще не было.
+// Новым участникам прежняя переписка не засчитывается как непрочитанная.
+func addChatMembers(tx *sql.Tx, chatID string, userIDs []string, role string) ([]string, error) {
+	rows, err := tx.Query(`
+		INSERT INTO chat_members (chat_id, user_id, role)
+		SELECT $1, u, $3 FROM unnest($2::uuid[]) AS u
+		ON CONFLICT DO NOTHING
+		RETURNING user_id
+	`, chatID, pq.Array(userIDs), role)
+	if err != nil {
+		return nil, err
+	}
+	var added []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		added = append(added, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO chat_reads (chat_id, user_id, last_read_seq)
+		SELECT c.id, u, c.last_seq FROM chats c, unnest($2::uuid[]) AS u
+		WHERE c.id = $1
+		ON CONFLICT (chat_id, user_id) DO UPDATE
+		SET last_read_seq = GREATEST(chat_reads.last_read_seq, EXCLUDED.last_read_seq), updated_at = now()
+	`, chatID, pq.Array(added))
+	return added, err
+}
+
+// removeChatMember исключает участника. Если в группе не осталось администраторов,
+// администратором становится тот, кто состоит в ней дольше всех.
+func removeChatMember(tx *sql.Tx, chatID, userID string) error {
+	if _, err := tx.Exec("DELETE FROM chat_members WHERE chat_id = $1 AND user_id = $2", chatID, userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE chat_members SET role = 'admin'
+		WHERE chat_id = $1
+		  AND NOT EXISTS (SELECT 1 FROM chat_members WHERE chat_id = $1 AND role = 'admin')
+		  AND user_id = (SELECT user_id FROM chat_members WHERE chat_id = $1 ORDER BY joined_at, user_id LIMIT 1)
+	`, chatID)
+	return err
+}
+
+// POST /chats/groups — создать групповой чат. Создатель становится администратором.
+func createGroupChatHandler(c *gin.Context) {
+	userID := currentUserID(c)
+
+	var request struct {
+		Title       string   `json:"title"`
+		MemberIDs   []string `json:"member_ids"`
+		ApartmentID *int     `json:"apartment_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+
+	title, ok := validGroupTitle(request.Title)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Название должно содержать от 1 до %d символов", maxGroupTitleLength)})
+		return
+	}
+	members, err := parseUserIDs(request.MemberIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	others := make([]string, 0, len(members))
+	for _, id := range members {
+		if id != userID {
+			others = append(others, id)
+		}
+	}
+	if len(others) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Добавьте в группу хотя бы одного участника"})
+		return
+	}
+	if len(others)+1 > maxGroupMembers {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("В группе может быть не больше %d участников", maxGroupMembers)})
+		return
+	}
+
+	missing, err := missingUsers(others)
+	if err != nil {
+		log.Println("Ошибка проверки участников:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки участников"})
+		return
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден", "user_ids": missing})
+		return
+	}
+
+	var apartmentID sql.NullInt64
+	if request.ApartmentID != nil {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM apartments WHERE id = $1 AND deleted_at IS NULL)", *request.ApartmentID).Scan(&exists); err != nil {
+			log.Println("Ошибка проверки квартиры:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+			return
+		}
+		apartmentID = sql.NullInt64{Int64: int64(*request.ApartmentID), Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
+		return
+	}
+	defer tx.Rollback()
+
+	chatID := uuid.New().String()
+	_, err = tx.Exec("INSERT INTO chats (id, kind, title, apartment_id) VALUES ($1, $2, $3, $4)",
+		chatID, chatKindGroup, title, apartmentID)
+	if err == nil {
+		_, err = addChatMembers(tx, chatID, []string{userID}, chatRoleAdmin)
+	}
+	if err == nil {
+		_, err = addChatMembers(tx, chatID, others, chatRoleMember)
+	}
+	var posted postedMessage
+	if err == nil {
+		posted, err = postChatSystemMessage(tx, chatID,
+			fmt.Sprintf("%s создает группу «%s»", displayNames([]string{userID}), title),
+			gin.H{"type": systemChatCreated, "actor_id": userID, "title": title, "user_ids": others})
+	}
+	if err != nil {
+		log.Println("Ошибка создания группового чата:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
+		return
+	}
+	if !commitAndPublish(c, tx, posted) {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Чат создан", "chat_id": chatID})
+}
+
+// PATCH /chats/:chat_id — переименовать групповой чат (только администратор).
+func renameChatHandler(c *gin.Context) {
+	chatID := c.Param("chat_id")
+	userID := currentUserID(c)
+
+	var request struct {
+		Title string `json:"title"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	title, ok := validGroupTitle(request.Title)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Название должно содержать от 1 до %d символов", maxGroupTitleLength)})
+		return
+	}
+
+	tx, role := membershipRequest(c, chatID, userID)
+	if tx == nil {
+		return
+	}
+	defer tx.Rollback()
+	if role != chatRoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Переименовать чат может только администратор"})
+		return
+	}
+
+	_, err := tx.Exec("UPDATE chats SET title = $1 WHERE id = $2", title, chatID)
+	var posted postedMessage
+	if err == nil {
+		posted, err = postChatSystemMessage(tx, chatID,
+			fmt.Sprintf("%s переименовывает группу в «%s»", displayNames([]string{userID}), title),
+			gin.H{"type": systemChatRenamed, "actor_id": userID, "title": title})
+	}
+	if err != nil {
+		log.Println("Ошибка переименования чата:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+		return
+	}
+	if !commitAndPublish(c, tx, posted) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Чат переименован", "chat_id": chatID, "title": title})
+}
+
+// POST /chats/:chat_id/members — добавить участников (только администратор).
+func addChatMembersHandler(c *gin.Context) {
+	chatID := c.Param("chat_id")
+	userID := currentUserID(c)
+
+	var request struct {
+		UserIDs []string `json:"user_ids"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	userIDs, err := parseUserIDs(request.UserIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(userIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Нужно указать user_ids"})
+		return
+	}
+	missing, err := missingUsers(userIDs)
+	if err != nil {
+		log.Println("Ошибка проверки участников:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки участников"})
+		return
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден", "user_ids": missing})
+		return
+	}
+
+	tx, role := membershipRequest(c, chatID, userID)
+	if tx == nil {
+		return
+	}
+	defer tx.Rollback()
+	if role != chatRoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Добавлять участников может только администратор"})
+		return
+	}
+
+	var count int
+	if err := tx.QueryRow(`
+		SELECT count(*) FROM (
+			SELECT user_id FROM chat_members WHERE chat_id = $1
+			UNION
+			SELECT unnest($2::uuid[])
+		) m
+	`, chatID, pq.Array(userIDs)).Scan(&count); err != nil {
+		log.Println("Ошибка добавления участников:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+		return
+	}
+	if count > maxGroupMembers {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("В группе может быть не больше %d участников", maxGroupMembers)})
+		return
+	}
+
+	added, err := addChatMembers(tx, chatID, userIDs, chatRoleMember)
+	var posted []postedMessage
+	if err == nil && len(added) > 0 {
+		var p postedMessage
+		p, err = postChatSystemMessage(tx, chatID,
+			fmt.Sprintf("%s добавляет в группу: %s", displayNames([]string{userID}), displayNames(added)),
+			gin.H{"type": systemChatMemberAdded, "actor_id": userID, "user_ids": added})
+		posted = append(posted, p)
+	}
+	if err != nil {
+		log.Println("Ошибка добавления участников:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+		return
+	}
+	if !commitAndPublish(c, tx, posted...) {
+		return
+	}
+
+	if added == nil {
+		added = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Участники добавлены", "chat_id": chatID, "added": added})
+}
+
+// DELETE /chats/:chat_id/members/:user_id — исключить участника (администратор)
+// или выйти из группы самому. POST /chats/:chat_id/leave — то же для себя.
+func removeChatMemberHandler(c *gin.Context) {
+	chatID := c.Param("chat_id")
+	userID := currentUserID(c)
+
+	target := userID
+	if param := c.Param("user_id"); param != "" {
+		parsed, err := uuid.Parse(param)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Участник не найден"})
+			return
+		}
+		target = parsed.String()
+	}
+
+	tx, role := membershipRequest(c, chatID, userID)
+	if tx == nil {
+		return
+	}
+	defer tx.Rollback()
+
+	leaving := target == userID
+	if !leaving {
+		if role != chatRoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Исключать участников может только администратор"})
+			return
+		}
+		member, err := isChatMember(tx, chatID, target)
+		if err != nil {
+			log.Println("Ошибка проверки участника:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+			return
+		}
+		if !member {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Участник не найден"})
+			return
+		}
+	}
+
+	err := removeChatMember(tx, chatID, target)
+	var posted postedMessage
+	if err == nil {
+		text := fmt.Sprintf("%s покидает группу", displayNames([]string{target}))
+		system := gin.H{"type": systemChatMemberLeft, "user_id": target}
+		if !leaving {
+			text = fmt.Sprintf("%s исключает из группы: %s", displayNames([]string{userID}), displayNames([]string{target}))
+			system = gin.H{"type": systemChatMemberRemoved, "actor_id": userID, "user_id": target}
+		}
+		posted, err = postChatSystemMessage(tx, chatID, text, system, target)
+	}
+	if err != nil {
+		log.Println("Ошибка исключения участника:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+		return
+	}
+	if !commitAndPublish(c, tx, posted) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// PUT /chats/:chat_id/members/:user_id/role — назначить или снять администратора.
+// Последнего администратора понизить нельзя: сначала нужно назначить другого.
+func setChatMemberRoleHandler(c *gin.Context) {
+	chatID := c.Param("chat_id")
+	userID := currentUserID(c)
+
+	target, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Участник не найден"})
+		return
+	}
+	var request struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	if request.Role != chatRoleMember && request.Role != chatRoleAdmin {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Роль должна быть member или admin"})
+		return
+	}
+
+	tx, role := membershipRequest(c, chatID, userID)
+	if tx == nil {
+		return
+	}
+	defer tx.Rollback()
+	if role != chatRoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Менять роли может только администратор"})
+		return
+	}
+
+	var current string
+	var admins int
+	err = tx.QueryRow(`
+		SELECT role, (SELECT count(*) FROM chat_members WHERE chat_id = $1 AND role = 'admin')
+		FROM chat_members WHERE chat_id = $1 AND user_id = $2
+	`, chatID, target.String()).Scan(&current, &admins)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Участник не найден"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения участника:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+		return
+	}
+	if current == request.Role {
+		c.JSON(http.StatusOK, gin.H{"message": "Роль не изменилась", "user_id": target.String(), "role": current})
+		return
+	}
+	if current == chatRoleAdmin && admins == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "В группе должен остаться хотя бы один администратор"})
+		return
+	}
+
+	_, err = tx.Exec("UPDATE chat_members SET role = $1 WHERE chat_id = $2 AND user_id = $3", request.Role, chatID, target.String())
+	var posted postedMessage
+	if err == nil {
+		text := fmt.Sprintf("%s назначает администратором: %s", displayNames([]string{userID}), displayNames([]string{target.String()}))
+		if request.Role == chatRoleMember {
+			text = fmt.Sprintf("%s больше не администратор", displayNames([]string{target.String()}))
+		}
+		posted, err = postChatSystemMessage(tx, chatID, text,
+			gin.H{"type": systemChatRoleChanged, "actor_id": userID, "user_id": target.String(), "role": request.Role})
+	}
+	if err != nil {
+		log.Println("Ошибка изменения роли:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения чата"})
+		return
+	}
+	if !commitAndPublish(c, tx, posted) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Роль изменена", "user_id": target.String(), "role": request.Role})
+}
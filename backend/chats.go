@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type ChatParticipant struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type ChatSummary struct {
+	ID           string            `json:"id"`
+	Kind         string            `json:"kind"`
+	Title        *string           `json:"title"`
+	Role         string            `json:"role"` // роль текущего пользователя в чате
+	Participants []ChatParticipant `json:"participants"`
+	ApartmentID  *int              `json:"apartment_id"`
+	OrderID      *int              `json:"order_id"`
+	LastMessage  *Message          `json:"last_message"`
+	LastReadSeq  int64             `json:"last_read_seq"`
+	UnreadCount  int               `json:"unread_count"`
+}
+
+// GET /chats — чаты авторизованного пользователя, сначала самые свежие
+func getChatsHandler(c *gin.Context) {
+	userID := currentUserID(c)
+
+	rows, err := db.Query(`
+		SELECT c.id, c.kind, c.title, me.role, c.apartment_id, c.order_id, COALESCE(r.last_read_seq, 0),
+		       lm.id, lm.sender_id, lm.message, lm.seq, lm.created_at, lm.kind, lm.system, lm.reply_to_id, lm.edited_at, lm.deleted_at,
+		       (SELECT count(*) FROM messages m
+		        WHERE m.chat_id = c.id AND m.seq > COALESCE(r.last_read_seq, 0) AND m.sender_id IS DISTINCT FROM $1
+		          AND m.deleted_at IS NULL
+		          AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1))
+		FROM chat_members me
+		JOIN chats c ON c.id = me.chat_id
+		LEFT JOIN chat_reads r ON r.chat_id = c.id AND r.user_id = $1
+		LEFT JOIN LATERAL (
+			SELECT id, sender_id, message, seq, created_at, kind, system, reply_to_id, edited_at, deleted_at
+			FROM messages
+			WHERE chat_id = c.id
+			  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = $1)
+			ORDER BY seq DESC
+			LIMIT 1
+		) lm ON true
+		WHERE me.user_id = $1
+		ORDER BY lm.created_at DESC NULLS LAST, c.id
+	`, userID)
+	if err != nil {
+		log.Println("Ошибка получения списка чатов:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения чатов"})
+		return
+	}
+	defer rows.Close()
+
+	chats := []ChatSummary{}
+	var chatIDs []string
+	for rows.Next() {
+		var chat ChatSummary
+		var title sql.NullString
+		var apartmentID, orderID sql.NullInt64
+		var msgID, senderID, text, kind, replyTo sql.NullString
+		var system []byte
+		var seq sql.NullInt64
+		var createdAt, editedAt, deletedAt sql.NullTime
+		if err := rows.Scan(&chat.ID, &chat.Kind, &title, &chat.Role, &apartmentID, &orderID, &chat.LastReadSeq,
+			&msgID, &senderID, &text, &seq, &createdAt, &kind, &system, &replyTo, &editedAt, &deletedAt, &chat.UnreadCount); err != nil {
+			log.Println("Ошибка обработки чата:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки чатов"})
+			return
+		}
+		chat.Title = nullStringPtr(title)
+		chat.ApartmentID = nullIntPtr(apartmentID)
+		chat.OrderID = nullIntPtr(orderID)
+		if msgID.Valid {
+			chat.LastMessage = &Message{
+				ID: msgID.String, ChatID: chat.ID, SenderID: senderID.String,
+				Message: text.String, Seq: seq.Int64, CreatedAt: createdAt.Time,
+				Kind: kind.String, System: system,
+			}
+			if replyTo.Valid {
+				chat.LastMessage.ReplyToID = &replyTo.String
+			}
+			if editedAt.Valid {
+				chat.LastMessage.EditedAt = &editedAt.Time
+			}
+			if deletedAt.Valid {
+				chat.LastMessage.DeletedAt = &deletedAt.Time
+				chat.LastMessage.Message = ""
+			}
+		}
+		chatIDs = append(chatIDs, chat.ID)
+		chats = append(chats, chat)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка получения списка чатов:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения чатов"})
+		return
+	}
+
+	members, err := chatParticipants(chatIDs)
+	if err != nil {
+		log.Println("Ошибка получения участников чатов:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения чатов"})
+		return
+	}
+	for i := range chats {
+		chats[i].Participants = members[chats[i].ID]
+	}
+
+	c.JSON(http.StatusOK, chats)
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+// openChat возвращает личный чат пары по квартире и заказу, создавая его при необходимости.
+// participants должны быть приведены canonicalParticipants.
+func openChat(q querier, participants []string, apartmentID, orderID sql.NullInt64) (chatID string, created bool, err error) {
+	directKey := strings.Join(participants, ":")
+
+	// Чат и его участники появляются одним запросом, без отдельной транзакции
+	err = q.QueryRow(`
+		WITH created AS (
+			INSERT INTO chats (id, kind, direct_key, apartment_id, order_id) VALUES ($1, 'direct', $2, $3, $4)
+			ON CONFLICT (direct_key, (COALESCE(apartment_id, 0)), (COALESCE(order_id, 0))) WHERE direct_key IS NOT NULL
+			DO NOTHING
+			RETURNING id
+		), members AS (
+			INSERT INTO chat_members (chat_id, user_id)
+			SELECT created.id, p FROM created, unnest($5::uuid[]) AS p
+		)
+		SELECT id FROM created
+	`, uuid.New().String(), directKey, apartmentID, orderID, pq.Array(participants)).Scan(&chatID)
+	if err == nil {
+		return chatID, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", false, err
+	}
+
+	err = q.QueryRow(`
+		SELECT id FROM chats
+		WHERE direct_key = $1
+		  AND apartment_id IS NOT DISTINCT FROM $2 AND order_id IS NOT DISTINCT FROM $3
+	`, directKey, apartmentID, orderID).Scan(&chatID)
+	return chatID, false, err
+}
+
+// querier — общее у *sql.DB и *sql.Tx
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// chatMembers возвращает идентификаторы участников чата.
+func chatMembers(q querier, chatID string) ([]string, error) {
+	rows, err := q.Query("SELECT user_id FROM chat_members WHERE chat_id = $1 ORDER BY user_id", chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		members = append(members, id)
+	}
+	return members, rows.Err()
+}
+
+func isChatMember(q querier, chatID, userID string) (bool, error) {
+	var member bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM chat_members WHERE chat_id = $1 AND user_id = $2)", chatID, userID).Scan(&member)
+	return member, err
+}
+
+// chatParticipants возвращает участников чатов с именами и ролями, в порядке вступления.
+func chatParticipants(chatIDs []string) (map[string][]ChatParticipant, error) {
+	participants := map[string][]ChatParticipant{}
+	if len(chatIDs) == 0 {
+		return participants, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT m.chat_id, m.user_id, m.role, COALESCE(u.name, '')
+		FROM chat_members m
+		LEFT JOIN users u ON u.id = m.user_id
+		WHERE m.chat_id = ANY($1::uuid[])
+		ORDER BY m.chat_id, m.joined_at, m.user_id
+	`, pq.Array(chatIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chatID string
+		var p ChatParticipant
+		if err := rows.Scan(&chatID, &p.ID, &p.Role, &p.Name); err != nil {
+			return nil, err
+		}
+		participants[chatID] = append(participants[chatID], p)
+	}
+	return participants, rows.Err()
+}
+
+// POST /apartments/:id/contact — написать хозяину квартиры.
+// Открывает чат гостя с хозяином по этой квартире или возвращает уже существующий.
+// С order_id чат привязывается к бронированию гостя.
+func contactHostHandler(c *gin.Context) {
+	userID := currentUserID(c)
+
+	apartmentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	}
+
+	var request struct {
+		OrderID *int `json:"order_id"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+			return
+		}
+	}
+
+	var hostID sql.NullString
+	err = db.QueryRow("SELECT host_id FROM apartments WHERE id = $1 AND deleted_at IS NULL", apartmentID).Scan(&hostID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения квартиры:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
+		return
+	}
+	if !hostID.Valid {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "У квартиры не указан хозяин"})
+		return
+	}
+
+	participants, err := canonicalParticipants([]string{userID, hostID.String})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Это ваша квартира"})
+		return
+	}
+
+	var orderID sql.NullInt64
+	if request.OrderID != nil {
+		var owned, hasApartment bool
+		err := db.QueryRow(`
+			SELECT o.user_id::text = $2,
+			       EXISTS (SELECT 1 FROM order_items oi WHERE oi.order_id = o.id AND oi.apartment_id = $3)
+			FROM orders o WHERE o.id = $1
+		`, *request.OrderID, userID, apartmentID).Scan(&owned, &hasApartment)
+		if err == sql.ErrNoRows || (err == nil && !owned) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Заказ не найден"})
+			return
+		} else if err != nil {
+			log.Println("Ошибка получения заказа:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
+			return
+		}
+		if !hasApartment {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Эта квартира не входит в заказ"})
+			return
+		}
+		orderID = sql.NullInt64{Int64: int64(*request.OrderID), Valid: true}
+	}
+
+	chatID, created, err := openChat(db, participants, sql.NullInt64{Int64: int64(apartmentID), Valid: true}, orderID)
+	if err != nil {
+		log.Println("Ошибка при создании чата:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
+		return
+	}
+	if created {
+		c.JSON(http.StatusOK, gin.H{"message": "Чат создан", "chat_id": chatID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Чат найден", "chat_id": chatID})
+}
+
+// userNames возвращает имена пользователей по их идентификаторам.
+func userNames(ids []string) (map[string]string, error) {
+	names := map[string]string{}
+	if len(ids) == 0 {
+		return names, nil
+	}
+
+	rows, err := db.Query("SELECT id, name FROM users WHERE id = ANY($1::uuid[])", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var name sql.NullString
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name.String
+	}
+	return names, rows.Err()
+}
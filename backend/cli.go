@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// runCommand выполняет подкоманду вместо запуска сервера и возвращает код выхода.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "import":
+		return importCommand(args[1:])
+	case "export":
+		return exportCommand(args[1:])
+	case "mail-test":
+		return mailTestCommand(args[1:])
+	case "migrate":
+		return migrateCommand(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "Неизвестная команда %q\n", args[0])
+	fmt.Fprintln(os.Stderr, "Использование: backend [import|export|mail-test|migrate] [флаги]")
+	return 2
+}
+
+// backend import -format csv -file flats.csv [-dry-run] [-chunked -chunk-size 500 -start-row N]
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := fs.String("file", "-", "файл для загрузки, - для stdin")
+	format := fs.String("format", formatCSV, "формат файла: csv или ndjson")
+	dryRun := fs.Bool("dry-run", false, "только проверить файл, ничего не сохраняя")
+	chunked := fs.Bool("chunked", false, "фиксировать каждую пачку отдельно вместо одной транзакции")
+	chunkSize := fs.Int("chunk-size", 500, "размер пачки для -chunked")
+	startRow := fs.Int("start-row", 1, "номер строки, с которой продолжить загрузку")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Не удалось открыть файл:", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	initDB()
+	report, err := importApartments(in, importOptions{
+		Format:    *format,
+		DryRun:    *dryRun,
+		Chunked:   *chunked,
+		ChunkSize: *chunkSize,
+		StartRow:  *startRow,
+	})
+	if report != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Импорт прерван:", err)
+		return 1
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// backend export -format ndjson > flats.ndjson
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", formatCSV, "формат выгрузки: csv или ndjson")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	initDB()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if err := exportApartments(out, *format, nil); err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка экспорта:", err)
+		return 1
+	}
+	return 0
+}
+
+// backend mail-test -to user@example.com — проверить настройки SMTP_*,
+// например с локальным тестовым сервером: SMTP_ADDR=localhost:1025
+func mailTestCommand(args []string) int {
+	fs := flag.NewFlagSet("mail-test", flag.ContinueOnError)
+	to := fs.String("to", "", "адрес получателя")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	mailer := smtpMailerFromConfig()
+	if *to == "" || mailer == nil {
+		fmt.Fprintln(os.Stderr, "Нужно указать -to и адрес SMTP-сервера (SMTP_ADDR)")
+		return 2
+	}
+
+	if err := mailer.Send(*to, "Проверка уведомлений", "Если вы видите это письмо, почта настроена."); err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка отправки письма:", err)
+		return 1
+	}
+	return 0
+}
+
+// backend migrate up | down [-steps N] | to -version N | status | mark -version N
+func migrateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Использование: backend migrate [up|down|to|status|mark] [флаги]")
+		return 2
+	}
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	steps := fs.Int("steps", 1, "сколько последних миграций откатить (для down)")
+	version := fs.Int("version", -1, "целевая версия схемы (для to и mark)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	switch args[0] {
+	case "up", "status":
+	case "down":
+		if *steps <= 0 {
+			fmt.Fprintln(os.Stderr, "-steps должно быть положительным")
+			return 2
+		}
+	case "to", "mark":
+		if *version < 0 {
+			fmt.Fprintln(os.Stderr, "Нужно указать -version")
+			return 2
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Неизвестная команда migrate %q\n", args[0])
+		return 2
+	}
+
+	initDB()
+	ctx := context.Background()
+	var n int
+	var err error
+	switch args[0] {
+	case "status":
+		return migrateStatusCommand(ctx)
+	case "up":
+		n, err = migrateUp(ctx)
+	case "down":
+		n, err = migrateDown(ctx, *steps)
+	case "to":
+		n, err = migrateTo(ctx, *version)
+	case "mark":
+		// База, схему которой создавали вручную: миграции до -version в ней уже есть
+		n, err = markMigrationsApplied(ctx, *version)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка миграции:", err)
+		return 1
+	}
+	fmt.Printf("Готово, затронуто миграций: %d\n", n)
+	return 0
+}
+
+func migrateStatusCommand(ctx context.Context) int {
+	status, err := migrationsStatus(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Ошибка получения статуса миграций:", err)
+		return 1
+	}
+	for _, s := range status {
+		state := "не применена"
+		if s.appliedAt != nil {
+			state = "применена " + s.appliedAt.Format(time.DateTime)
+		}
+		if s.missing {
+			state += ", нет в этой версии бэкенда"
+		}
+		fmt.Printf("%04d_%-30s %s\n", s.version, s.name, state)
+	}
+	return 0
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret — строка, которая не попадает в логи: при выводе печатается маска.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "***"
+}
+
+func (s Secret) GoString() string { return s.String() }
+
+// Config — все настройки сервера. Значения берутся из defaultConfig, затем из
+// YAML-файла CONFIG_FILE, если он задан, затем из переменных окружения (тег env).
+type Config struct {
+	Server      ServerConfig      `yaml:"server"`
+	Database    DatabaseConfig    `yaml:"database"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Realtime    RealtimeConfig    `yaml:"realtime"`
+	Attachments AttachmentsConfig `yaml:"attachments"`
+	Moderation  ModerationConfig  `yaml:"moderation"`
+	SMTP        SMTPConfig        `yaml:"smtp"`
+	Push        PushConfig        `yaml:"push"`
+	Jobs        JobsConfig        `yaml:"jobs"`
+	// Части сервера, которые можно выключить на отдельных экземплярах
+	Features FeaturesConfig `yaml:"features"`
+}
+
+type ServerConfig struct {
+	Addr              string        `yaml:"addr" env:"HTTP_ADDR"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	// Ограничивают весь запрос, поэтому по умолчанию выключены:
+	// загрузка вложений и потоки SSE могут идти долго
+	ReadTimeout     time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"HTTP_SHUTDOWN_TIMEOUT"`
+	TLS             TLSConfig     `yaml:"tls"`
+}
+
+// Без сертификата сервер работает по HTTP
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"TLS_KEY_FILE"`
+}
+
+type DatabaseConfig struct {
+	// Строка подключения целиком; если задана, отдельные параметры ниже не используются
+	URL             Secret        `yaml:"url" env:"DATABASE_URL"`
+	Host            string        `yaml:"host" env:"DB_HOST"`
+	Port            int           `yaml:"port" env:"DB_PORT"`
+	User            string        `yaml:"user" env:"DB_USER"`
+	Password        Secret        `yaml:"password" env:"DB_PASSWORD"`
+	Name            string        `yaml:"name" env:"DB_NAME"`
+	SSLMode         string        `yaml:"sslmode" env:"DB_SSLMODE"`
+	ConnectTimeout  time.Duration `yaml:"connect_timeout" env:"DB_CONNECT_TIMEOUT"`
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME"`
+	// Применять недостающие миграции при запуске сервера
+	AutoMigrate bool `yaml:"auto_migrate" env:"DB_AUTO_MIGRATE"`
+}
+
+type AuthConfig struct {
+	JWTSecret Secret `yaml:"jwt_secret" env:"SUPABASE_JWT_SECRET"`
+}
+
+type RealtimeConfig struct {
+	// memory — один экземпляр, postgres — несколько через LISTEN/NOTIFY
+	Backend string `yaml:"backend" env:"REALTIME_BACKEND"`
+}
+
+type AttachmentsConfig struct {
+	Dir       string `yaml:"dir" env:"ATTACHMENTS_DIR"`
+	URLSecret Secret `yaml:"url_secret" env:"ATTACHMENT_URL_SECRET"`
+}
+
+type ModerationConfig struct {
+	Rules         string `yaml:"rules" env:"MODERATION_RULES"`
+	ProfanityFile string `yaml:"profanity_file" env:"MODERATION_PROFANITY_FILE"`
+}
+
+type SMTPConfig struct {
+	// Без адреса почта выключена
+	Addr     string `yaml:"addr" env:"SMTP_ADDR"`
+	From     string `yaml:"from" env:"SMTP_FROM"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password Secret `yaml:"password" env:"SMTP_PASSWORD"`
+}
+
+type PushConfig struct {
+	// Пусто — push-уведомления выключены, log — только пишутся в журнал сервера
+	Provider string `yaml:"provider" env:"PUSH_PROVIDER"`
+}
+
+type JobsConfig struct {
+	Workers      int           `yaml:"workers" env:"JOBS_WORKERS"`
+	PollInterval time.Duration `yaml:"poll_interval" env:"JOBS_POLL_INTERVAL"`
+}
+
+type FeaturesConfig struct {
+	Jobs      bool `yaml:"jobs" env:"FEATURE_JOBS"`           // выполнять фоновые задачи
+	Scheduler bool `yaml:"scheduler" env:"FEATURE_SCHEDULER"` // участвовать в выборе ведущего планировщика
+	Webhooks  bool `yaml:"webhooks" env:"FEATURE_WEBHOOKS"`   // API вебхуков для партнеров
+}
+
+var config *Config
+
+func defaultConfig() *Config {
+	c := &Config{}
+	c.Server.Addr = ":8080"
+	c.Server.ReadHeaderTimeout = 10 * time.Second
+	c.Server.IdleTimeout = 2 * time.Minute
+	c.Server.ShutdownTimeout = 30 * time.Second
+
+	c.Database.Host = "localhost"
+	c.Database.Port = 5432
+	c.Database.User = "postgres"
+	c.Database.Name = "apartments_db"
+	c.Database.SSLMode = "disable"
+	c.Database.ConnectTimeout = 5 * time.Second
+	c.Database.MaxOpenConns = 25
+	c.Database.MaxIdleConns = 10
+	c.Database.ConnMaxLifetime = 30 * time.Minute
+	c.Database.ConnMaxIdleTime = 5 * time.Minute
+
+	c.Realtime.Backend = "memory"
+	c.Attachments.Dir = "uploads"
+	c.Moderation.Rules = defaultModerationRules
+	c.SMTP.From = "noreply@localhost"
+
+	c.Jobs.Workers = 16
+	c.Jobs.PollInterval = time.Second
+
+	c.Features.Jobs = true
+	c.Features.Scheduler = true
+	c.Features.Webhooks = true
+	return c
+}
+
+// loadConfig собирает настройки и проверяет их. Ошибки во всех полях
+// возвращаются вместе, чтобы их можно было исправить за один раз.
+func loadConfig() (*Config, error) {
+	c := defaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("файл настроек: %w", err)
+		}
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		f.Close()
+		// Пустой файл — не ошибка
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("файл настроек %s: %w", path, err)
+		}
+	}
+
+	var errs []error
+	for _, f := range configFields(c) {
+		value, ok := os.LookupEnv(f.env)
+		if !ok || f.env == "" {
+			continue
+		}
+		if err := setConfigValue(f.value, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.env, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// initConfig загружает настройки и останавливает сервер, если они некорректны.
+func initConfig() {
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Некорректные настройки:\n%v", err)
+	}
+	config = c
+	jwtSecret = []byte(c.Auth.JWTSecret)
+	attachmentURLSecret = []byte(c.Attachments.URLSecret)
+	if len(jwtSecret) == 0 {
+		log.Println("SUPABASE_JWT_SECRET не задан, запросы с токенами будут отклоняться")
+	}
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	s := c.Server
+	check(s.Addr != "", "server.addr: адрес не задан")
+	check(s.ReadHeaderTimeout >= 0 && s.ReadTimeout >= 0 && s.WriteTimeout >= 0 && s.IdleTimeout >= 0,
+		"server: таймауты не могут быть отрицательными")
+	check(s.ShutdownTimeout > 0, "server.shutdown_timeout: должен быть больше нуля")
+	check((s.TLS.CertFile == "") == (s.TLS.KeyFile == ""), "server.tls: нужно задать и cert_file, и key_file")
+	for _, path := range []string{s.TLS.CertFile, s.TLS.KeyFile} {
+		if path != "" {
+			_, err := os.Stat(path)
+			check(err == nil, "server.tls: %v", err)
+		}
+	}
+
+	d := c.Database
+	if d.URL == "" {
+		check(d.Host != "", "database.host: не задан")
+		check(d.Port > 0 && d.Port < 65536, "database.port: %d вне диапазона 1-65535", d.Port)
+		check(d.User != "", "database.user: не задан")
+		check(d.Name != "", "database.name: не задано")
+		switch d.SSLMode {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			check(false, "database.sslmode: неизвестный режим %q", d.SSLMode)
+		}
+	}
+	check(d.ConnectTimeout >= 0, "database.connect_timeout: не может быть отрицательным")
+	// Ведущий планировщик держит одно соединение постоянно
+	check(d.MaxOpenConns == 0 || d.MaxOpenConns >= 2, "database.max_open_conns: нужно не меньше 2 (0 — без ограничения)")
+	check(d.MaxIdleConns >= 0, "database.max_idle_conns: не может быть отрицательным")
+	check(d.MaxOpenConns == 0 || d.MaxIdleConns <= d.MaxOpenConns, "database.max_idle_conns: больше max_open_conns")
+	check(d.ConnMaxLifetime >= 0 && d.ConnMaxIdleTime >= 0, "database: время жизни соединений не может быть отрицательным")
+
+	check(c.Realtime.Backend == "memory" || c.Realtime.Backend == "postgres",
+		"realtime.backend: должен быть memory или postgres, а не %q", c.Realtime.Backend)
+	check(c.Attachments.Dir != "", "attachments.dir: не задан")
+	check(c.SMTP.Addr == "" || c.SMTP.From != "", "smtp.from: нужен, если задан smtp.addr")
+	check(c.Push.Provider == "" || c.Push.Provider == "log", "push.provider: неизвестный провайдер %q", c.Push.Provider)
+	check(c.Jobs.Workers > 0, "jobs.workers: должно быть больше нуля")
+	check(c.Jobs.PollInterval >= 100*time.Millisecond, "jobs.poll_interval: не меньше 100ms")
+
+	return errors.Join(errs...)
+}
+
+// connString — строка подключения к PostgreSQL в формате ключ=значение.
+func (c *Config) connString() string {
+	d := c.Database
+	if d.URL != "" {
+		return string(d.URL)
+	}
+	quote := func(v string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+	}
+	parts := []string{
+		"host=" + quote(d.Host),
+		"port=" + strconv.Itoa(d.Port),
+		"user=" + quote(d.User),
+		"dbname=" + quote(d.Name),
+		"sslmode=" + d.SSLMode,
+	}
+	if d.Password != "" {
+		parts = append(parts, "password="+quote(string(d.Password)))
+	}
+	if d.ConnectTimeout > 0 {
+		// libpq принимает целые секунды, меньше двух не бывает
+		parts = append(parts, "connect_timeout="+strconv.Itoa(max(2, int(d.ConnectTimeout.Seconds()))))
+	}
+	return strings.Join(parts, " ")
+}
+
+// log выводит действующие настройки; секреты маскируются.
+func (c *Config) log() {
+	var b strings.Builder
+	for _, f := range configFields(c) {
+		fmt.Fprintf(&b, "\n  %s = %v", f.path, f.value.Interface())
+	}
+	log.Printf("Настройки:%s", b.String())
+}
+
+type configField struct {
+	path  string // как в YAML-файле: database.host
+	env   string
+	value reflect.Value
+}
+
+// configFields перечисляет все настройки с их путями и переменными окружения.
+func configFields(c *Config) []configField {
+	var fields []configField
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			path := prefix + strings.Split(sf.Tag.Get("yaml"), ",")[0]
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), path+".")
+				continue
+			}
+			fields = append(fields, configField{path: path, env: sf.Tag.Get("env"), value: v.Field(i)})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return fields
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setConfigValue(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("ожидается длительность вроде 30s или 5m")
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("ожидается целое число")
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("ожидается true или false")
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("неподдерживаемый тип %s", v.Type())
+	}
+	return nil
+}
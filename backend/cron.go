@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule — расписание в формате cron из пяти полей:
+// минута, час, день месяца, месяц, день недели (0 — воскресенье).
+// Поддерживаются *, списки через запятую, диапазоны a-b и шаг /n.
+type cronSchedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64 // битовые маски допустимых значений
+	// Если ограничены и день месяца, и день недели, подходит любой из них, как в cron
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+}
+
+var cronFields = []cronField{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("расписание %q: нужно 5 полей, а не %d", spec, len(fields))
+	}
+	masks := make([]uint64, len(fields))
+	for i, f := range fields {
+		mask, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("расписание %q: %w", spec, err)
+		}
+		masks[i] = mask
+	}
+	s := &cronSchedule{
+		spec:   spec,
+		minute: masks[0], hour: masks[1], dom: masks[2], month: masks[3], dow: masks[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("расписание %q никогда не срабатывает", spec)
+	}
+	return s, nil
+}
+
+func parseCronField(field string, r cronField) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("некорректный шаг в %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		lo, hi := r.min, r.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("некорректное значение %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("некорректное значение %q", part)
+				}
+			} else if step > 1 {
+				hi = r.max // "5/15" — с 5 до конца с шагом 15
+			}
+		}
+		if lo < r.min || hi > r.max || lo > hi {
+			return 0, fmt.Errorf("значение %q вне диапазона %d-%d", part, r.min, r.max)
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next возвращает первое подходящее время строго после t с точностью до минуты.
+// Если за пять лет такого нет (например, 30 февраля), возвращается нулевое время.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ETag строится из номера версии строки, который увеличивается при каждом изменении.
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// parseETagList разбирает значение If-Match / If-None-Match в список тегов.
+// Префикс слабого тега W/ сохраняется: If-Match требует сильного сравнения,
+// а If-None-Match — слабого, и отбрасывает его только второй.
+func parseETagList(header string) (tags []string, wildcard bool) {
+	for _, part := range strings.Split(header, ",") {
+		tag := strings.TrimSpace(part)
+		if tag == "" {
+			continue
+		}
+		if tag == "*" {
+			return nil, true
+		}
+		tags = append(tags, tag)
+	}
+	return tags, false
+}
+
+// ifMatchVersions возвращает версии из заголовка If-Match.
+// Пустой результат означает, что условие не задано или равно "*".
+// Теги, которые не являются номером версии, заведомо не совпадут ни с одной строкой,
+// поэтому они заменяются на -1. Слабый тег тоже никогда не совпадает (RFC 9110, 13.1.1),
+// и запрос с ним получает 412.
+func ifMatchVersions(c *gin.Context) []int64 {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return nil
+	}
+	tags, wildcard := parseETagList(header)
+	if wildcard {
+		return nil
+	}
+	versions := make([]int64, 0, len(tags))
+	for _, tag := range tags {
+		v, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+		if err != nil || strings.HasPrefix(tag, "W/") {
+			v = -1
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// notModified отвечает 304, если клиент уже держит актуальную версию ресурса.
+func notModified(c *gin.Context, etag string) bool {
+	header := c.GetHeader("If-None-Match")
+	if header == "" {
+		return false
+	}
+	tags, wildcard := parseETagList(header)
+	if !wildcard {
+		found := false
+		for _, tag := range tags {
+			if strings.TrimPrefix(tag, "W/") == etag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	c.Header("ETag", etag)
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// respondApartmentMiss отвечает на условное изменение квартиры, которое не затронуло ни одной строки:
+// 404, если квартиры нет, и 412, если она есть, но версия из If-Match устарела.
+func respondApartmentMiss(c *gin.Context, id any, versions []int64) {
+	if versions != nil {
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM apartments WHERE id = $1 AND deleted_at IS NULL)", id).Scan(&exists)
+		if err != nil {
+			log.Println("Ошибка проверки квартиры:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки квартиры"})
+			return
+		}
+		if exists {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Квартира была изменена другим пользователем"})
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+}
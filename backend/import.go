@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Форматы массового импорта и экспорта
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// Колонки CSV в том порядке, в котором их пишет экспорт
+var apartmentCSVHeader = []string{"external_ref", "id", "title", "address", "image_link", "description", "square_meters", "bedrooms", "price", "favourite"}
+
+// Поля, без которых новую квартиру создать нельзя
+var apartmentRequiredFields = []string{"title", "address", "square_meters", "price"}
+
+type importOptions struct {
+	Format    string
+	DryRun    bool
+	Chunked   bool // каждая пачка в своей транзакции, иначе весь файл в одной
+	ChunkSize int
+	StartRow  int // строки до этой уже загружены в прошлый раз
+	ChangedBy string
+}
+
+type importRowError struct {
+	Row         int               `json:"row"`
+	ExternalRef string            `json:"external_ref,omitempty"`
+	Error       string            `json:"error"`
+	Fields      map[string]string `json:"fields,omitempty"`
+}
+
+type importReport struct {
+	DryRun    bool             `json:"dry_run"`
+	Total     int              `json:"total"`
+	Created   int              `json:"created"`
+	Updated   int              `json:"updated"`
+	Failed    int              `json:"failed"`
+	Committed bool             `json:"committed"`
+	NextRow   int              `json:"next_row"` // с этой строки продолжать после сбоя
+	Errors    []importRowError `json:"errors"`
+}
+
+type importRecord struct {
+	Row    int
+	Fields map[string]json.RawMessage
+	// Строку не удалось разобрать; Fields в этом случае пустой
+	Error string
+}
+
+// apartmentRecordReader по одной отдает строки файла, приведенные к JSON-значениям,
+// чтобы CSV и NDJSON проверялись одними и теми же правилами.
+type apartmentRecordReader interface {
+	Next() (*importRecord, error)
+}
+
+type csvRecordReader struct {
+	r      *csv.Reader
+	header []string
+	row    int
+}
+
+func newCSVRecordReader(r io.Reader) (*csvRecordReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать заголовок CSV: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+	return &csvRecordReader{r: cr, header: header}, nil
+}
+
+func (c *csvRecordReader) Next() (*importRecord, error) {
+	values, err := c.r.Read()
+	// Испорченная строка (например, незакрытая кавычка) — ошибка этой строки,
+	// а не всего файла: чтение продолжается со следующей
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		c.row++
+		return &importRecord{Row: c.row, Error: fmt.Sprintf("ошибка разбора CSV в строке файла %d: %v", parseErr.Line, parseErr.Err)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.row++
+
+	fields := map[string]json.RawMessage{}
+	for i, name := range c.header {
+		if i >= len(values) || name == "" {
+			continue
+		}
+		fields[name] = csvValueToJSON(name, values[i])
+	}
+	return &importRecord{Row: c.row, Fields: fields}, nil
+}
+
+// csvValueToJSON превращает ячейку в JSON так, как ее ожидает валидатор поля:
+// числа и флаги передаются как есть, строки кавычатся, пустая ячейка — null.
+func csvValueToJSON(field, value string) json.RawMessage {
+	value = strings.TrimSpace(value)
+	switch field {
+	case "id", "square_meters", "bedrooms", "price", "favourite":
+		if value == "" {
+			return json.RawMessage("null")
+		}
+		if field == "favourite" {
+			value = strings.ToLower(value)
+		}
+		if json.Valid([]byte(value)) {
+			return json.RawMessage(value)
+		}
+	}
+	data, _ := json.Marshal(value)
+	return data
+}
+
+type ndjsonRecordReader struct {
+	s   *bufio.Scanner
+	row int
+}
+
+func newNDJSONRecordReader(r io.Reader) *ndjsonRecordReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &ndjsonRecordReader{s: s}
+}
+
+func (n *ndjsonRecordReader) Next() (*importRecord, error) {
+	for n.s.Scan() {
+		n.row++
+		line := bytes.TrimSpace(n.s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(line, &fields); err != nil || fields == nil {
+			return &importRecord{Row: n.row, Error: "строка не является JSON-объектом"}, nil
+		}
+		return &importRecord{Row: n.row, Fields: fields}, nil
+	}
+	if err := n.s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func newApartmentRecordReader(format string, r io.Reader) (apartmentRecordReader, error) {
+	switch format {
+	case formatCSV:
+		return newCSVRecordReader(r)
+	case formatNDJSON:
+		return newNDJSONRecordReader(r), nil
+	}
+	return nil, fmt.Errorf("неизвестный формат %q, поддерживаются csv и ndjson", format)
+}
+
+// validateApartmentRecord проверяет строку импорта теми же правилами, что и PATCH.
+// id из файла игнорируется: квартиры сопоставляются только по external_ref.
+func validateApartmentRecord(fields map[string]json.RawMessage) (Apartment, string, map[string]string) {
+	var a Apartment
+	fieldErrors := map[string]string{}
+
+	var externalRef string
+	if raw, ok := fields["external_ref"]; ok && !bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		if err := json.Unmarshal(raw, &externalRef); err != nil {
+			fieldErrors["external_ref"] = "должно быть строкой"
+		}
+		externalRef = strings.TrimSpace(externalRef)
+	}
+
+	for _, name := range apartmentRequiredFields {
+		if raw, ok := fields[name]; !ok || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			fieldErrors[name] = "обязательное поле"
+		}
+	}
+
+	for name, raw := range fields {
+		field, ok := apartmentPatchFields[name]
+		if !ok || fieldErrors[name] != "" || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			continue
+		}
+		value, msg := field.parse(raw)
+		if msg != "" {
+			fieldErrors[name] = msg
+			continue
+		}
+		switch name {
+		case "title":
+			a.Title = value.(string)
+		case "address":
+			a.Address = value.(string)
+		case "image_link":
+			a.ImageLink = value.(string)
+		case "description":
+			a.Description = value.(string)
+		case "square_meters":
+			a.SquareMeters = value.(int)
+		case "bedrooms":
+			a.Bedrooms = value.(int)
+		case "price":
+			a.Price = value.(float64)
+		case "favourite":
+			a.Favourite = value.(bool)
+		}
+	}
+
+	return a, externalRef, fieldErrors
+}
+
+var errImportDeleted = errors.New("квартира с таким external_ref удалена, сначала восстановите ее")
+
+// upsertImportedApartment создает квартиру или обновляет найденную по external_ref.
+// Строка файла описывает квартиру целиком, поэтому пропущенные необязательные поля обнуляются.
+func upsertImportedApartment(tx *sql.Tx, a Apartment, externalRef, changedBy string) (created bool, err error) {
+	if externalRef != "" {
+		var id int
+		var deleted bool
+		err := tx.QueryRow("SELECT id, deleted_at IS NOT NULL FROM apartments WHERE external_ref = $1", externalRef).Scan(&id, &deleted)
+		if err == nil {
+			if deleted {
+				return false, errImportDeleted
+			}
+			_, err = changeApartmentTx(tx, id, revisionUpdate, changedBy, nil, func(tx *sql.Tx) (*Apartment, error) {
+				var updated Apartment
+				err := scanApartment(tx.QueryRow(`
+					UPDATE apartments
+					SET title = $1, address = $2, image_link = $3, description = $4,
+					    square_meters = $5, bedrooms = $6, price = $7, favourite = $8,
+					    version = version + 1
+					WHERE id = $9
+					RETURNING `+apartmentColumns,
+					a.Title, a.Address, a.ImageLink, a.Description, a.SquareMeters, a.Bedrooms, a.Price, a.Favourite, id), &updated)
+				return &updated, err
+			})
+			return false, err
+		} else if err != sql.ErrNoRows {
+			return false, err
+		}
+	}
+
+	var ref sql.NullString
+	if externalRef != "" {
+		ref = sql.NullString{String: externalRef, Valid: true}
+	}
+	err = scanApartment(tx.QueryRow(`
+		INSERT INTO apartments (title, address, image_link, description, square_meters, bedrooms, price, favourite, external_ref)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+apartmentColumns,
+		a.Title, a.Address, a.ImageLink, a.Description, a.SquareMeters, a.Bedrooms, a.Price, a.Favourite, ref), &a)
+	if err != nil {
+		return false, err
+	}
+	return true, recordApartmentRevision(tx, revisionCreate, changedBy, nil, nil, &a)
+}
+
+// importApartments загружает квартиры из CSV или NDJSON.
+// Без Chunked весь файл идет одной транзакцией и применяется, только если в нем нет ошибок.
+// С Chunked каждая пачка фиксируется отдельно, строки с ошибками пропускаются,
+// а NextRow показывает, откуда продолжить, если загрузка оборвалась.
+// При DryRun все изменения откатываются, но отчет считается так же, как при настоящей загрузке.
+func importApartments(r io.Reader, opts importOptions) (*importReport, error) {
+	reader, err := newApartmentRecordReader(opts.Format, r)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 500
+	}
+	if opts.StartRow < 1 {
+		opts.StartRow = 1
+	}
+
+	report := &importReport{DryRun: opts.DryRun, NextRow: opts.StartRow, Errors: []importRowError{}}
+	seenRefs := map[string]int{}
+
+	var tx *sql.Tx
+	inChunk, chunkCreated, chunkUpdated := 0, 0, 0
+	lastRow := opts.StartRow - 1
+
+	finishChunk := func() error {
+		if tx == nil {
+			return nil
+		}
+		var err error
+		if opts.DryRun {
+			err = tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+		tx = nil
+		if err != nil {
+			return err
+		}
+		report.Created += chunkCreated
+		report.Updated += chunkUpdated
+		report.NextRow = lastRow + 1
+		inChunk, chunkCreated, chunkUpdated = 0, 0, 0
+		return nil
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("ошибка чтения файла: %w", err)
+		}
+		if record.Row < opts.StartRow {
+			continue
+		}
+		report.Total++
+
+		rowErr := importRowError{Row: record.Row}
+		if record.Error != "" {
+			rowErr.Error = record.Error
+			report.Errors = append(report.Errors, rowErr)
+			report.Failed++
+			lastRow = record.Row
+			continue
+		}
+
+		apartment, externalRef, fieldErrors := validateApartmentRecord(record.Fields)
+		rowErr.ExternalRef = externalRef
+		if externalRef != "" {
+			if first, ok := seenRefs[externalRef]; ok {
+				rowErr.Error = fmt.Sprintf("external_ref уже встречался в строке %d", first)
+				report.Errors = append(report.Errors, rowErr)
+				report.Failed++
+				lastRow = record.Row
+				continue
+			}
+			seenRefs[externalRef] = record.Row
+		}
+		if len(fieldErrors) > 0 {
+			rowErr.Error = "Ошибка валидации"
+			rowErr.Fields = fieldErrors
+			report.Errors = append(report.Errors, rowErr)
+			report.Failed++
+			lastRow = record.Row
+			continue
+		}
+
+		if tx == nil {
+			if tx, err = db.Begin(); err != nil {
+				return report, err
+			}
+		}
+
+		// Точка сохранения нужна, чтобы ошибка в одной строке не обрывала всю транзакцию
+		if _, err := tx.Exec("SAVEPOINT import_row"); err != nil {
+			return report, err
+		}
+		created, err := upsertImportedApartment(tx, apartment, externalRef, opts.ChangedBy)
+		if err != nil {
+			if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT import_row"); rbErr != nil {
+				return report, rbErr
+			}
+			rowErr.Error = err.Error()
+			report.Errors = append(report.Errors, rowErr)
+			report.Failed++
+		} else {
+			if _, err := tx.Exec("RELEASE SAVEPOINT import_row"); err != nil {
+				return report, err
+			}
+			if created {
+				chunkCreated++
+			} else {
+				chunkUpdated++
+			}
+		}
+		lastRow = record.Row
+		inChunk++
+
+		if opts.Chunked && inChunk >= opts.ChunkSize {
+			if err := finishChunk(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if !opts.Chunked && report.Failed > 0 {
+		// Одна транзакция: применяем все или ничего
+		return report, nil
+	}
+	if err := finishChunk(); err != nil {
+		return report, err
+	}
+	report.NextRow = lastRow + 1
+	report.Committed = !opts.DryRun
+	return report, nil
+}
+
+// POST /admin/apartments/import?format=csv|ndjson&dry_run=&mode=atomic|chunked&chunk_size=&start_row=
+func importApartmentsHandler(c *gin.Context) {
+	opts := importOptions{
+		Format:    c.DefaultQuery("format", formatCSV),
+		DryRun:    c.Query("dry_run") == "true",
+		ChangedBy: currentUserID(c),
+	}
+
+	switch c.DefaultQuery("mode", "atomic") {
+	case "atomic":
+	case "chunked":
+		opts.Chunked = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode должен быть atomic или chunked"})
+		return
+	}
+
+	var err error
+	if v := c.Query("chunk_size"); v != "" {
+		if opts.ChunkSize, err = strconv.Atoi(v); err != nil || opts.ChunkSize < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный chunk_size"})
+			return
+		}
+	}
+	if v := c.Query("start_row"); v != "" {
+		if opts.StartRow, err = strconv.Atoi(v); err != nil || opts.StartRow < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный start_row"})
+			return
+		}
+	}
+
+	report, err := importApartments(c.Request.Body, opts)
+	if err != nil {
+		log.Println("Ошибка импорта квартир:", err)
+		if report == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Импорт прерван", "report": report})
+		return
+	}
+
+	status := http.StatusOK
+	if report.Failed > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	c.JSON(status, report)
+}
+
+// exportApartments пишет каталог в w построчно, не загружая его в память целиком.
+func exportApartments(w io.Writer, format string, flush func()) error {
+	if format != formatCSV && format != formatNDJSON {
+		return fmt.Errorf("неизвестный формат %q, поддерживаются csv и ndjson", format)
+	}
+
+	rows, err := db.Query("SELECT " + apartmentColumns + ", external_ref FROM apartments WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var cw *csv.Writer
+	if format == formatCSV {
+		cw = csv.NewWriter(w)
+		if err := cw.Write(apartmentCSVHeader); err != nil {
+			return err
+		}
+	}
+	encoder := json.NewEncoder(w)
+
+	for n := 1; rows.Next(); n++ {
+		var ref sql.NullString
+		var a Apartment
+		if err := scanApartment(rows, &a, &ref); err != nil {
+			return err
+		}
+
+		if cw != nil {
+			err = cw.Write([]string{
+				ref.String, strconv.Itoa(a.ID), a.Title, a.Address, a.ImageLink, a.Description,
+				strconv.Itoa(a.SquareMeters), strconv.Itoa(a.Bedrooms),
+				strconv.FormatFloat(a.Price, 'f', -1, 64), strconv.FormatBool(a.Favourite),
+			})
+		} else {
+			err = encoder.Encode(struct {
+				ExternalRef *string `json:"external_ref"`
+				Apartment
+			}{nullStringPtr(ref), a})
+		}
+		if err != nil {
+			return err
+		}
+
+		if n%100 == 0 {
+			if cw != nil {
+				cw.Flush()
+			}
+			if flush != nil {
+				flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if cw != nil {
+		cw.Flush()
+		return cw.Error()
+	}
+	return nil
+}
+
+func nullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+// GET /admin/apartments/export?format=csv|ndjson
+func exportApartmentsHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", formatCSV)
+	switch format {
+	case formatCSV:
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	case formatNDJSON:
+		c.Header("Content-Type", "application/x-ndjson")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format должен быть csv или ndjson"})
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=apartments."+format)
+	c.Status(http.StatusOK)
+
+	// Заголовки уже отправлены, поэтому об ошибке посреди потока остается только написать в лог
+	if err := exportApartments(c.Writer, format, c.Writer.Flush); err != nil {
+		log.Println("Ошибка экспорта квартир:", err)
+	}
+}
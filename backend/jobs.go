@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	mathrand "math/rand/v2"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Статусы задач
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed" // попытки кончились или ошибка неисправима
+)
+
+const (
+	// Между попытками 5 с, 10 с, 20 с... но не больше jobMaxBackoff
+	jobBaseBackoff = 5 * time.Second
+	jobMaxBackoff  = time.Hour
+	// Задача остается за узлом на время выполнения и еще столько же,
+	// чтобы успеть записать результат. Потом ее может взять другой узел
+	jobLockMargin = 30 * time.Second
+	// Сколько хранятся завершенные задачи
+	jobRetention = 7 * 24 * time.Hour
+)
+
+// jobOptions — как выполняется задача одного вида.
+type jobOptions struct {
+	MaxAttempts int           // по умолчанию 5
+	Timeout     time.Duration // по умолчанию минута
+	// Сколько задач этого вида один узел выполняет одновременно, 0 — без ограничения
+	Concurrency int
+}
+
+// enqueueOptions — когда и в каком виде ставится задача.
+type enqueueOptions struct {
+	RunAt time.Time // пустое — как можно скорее
+	// Пока в очереди ждет задача того же вида с этим ключом, новая не ставится
+	UniqueKey string
+}
+
+type jobDefinition struct {
+	kind string
+	opts jobOptions
+	run  func(ctx context.Context, args json.RawMessage) error
+}
+
+var jobDefinitions = map[string]*jobDefinition{}
+
+// jobKind — вид задачи с аргументами типа T. Аргументы хранятся в jobs.args как JSON.
+type jobKind[T any] struct {
+	name string
+}
+
+// defineJob регистрирует обработчик задач вида name. Вызывается при инициализации
+// пакета, поэтому виды задач известны раньше, чем запустится обработчик очереди.
+func defineJob[T any](name string, opts jobOptions, handle func(ctx context.Context, args T) error) jobKind[T] {
+	if _, ok := jobDefinitions[name]; ok {
+		panic("задача " + name + " уже зарегистрирована")
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Minute
+	}
+	jobDefinitions[name] = &jobDefinition{
+		kind: name,
+		opts: opts,
+		run: func(ctx context.Context, raw json.RawMessage) error {
+			var args T
+			if err := decodeJobArgs(raw, &args); err != nil {
+				return permanentJobError(fmt.Errorf("некорректные аргументы: %w", err))
+			}
+			return handle(ctx, args)
+		},
+	}
+	return jobKind[T]{name: name}
+}
+
+// decodeJobArgs читает аргументы задачи. Числа внутри map[string]any и any
+// остаются json.Number, а не float64: иначе номер заказа 1234567 превратился
+// бы в шаблоне уведомления в 1.234567e+06.
+func decodeJobArgs(raw json.RawMessage, args any) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	return decoder.Decode(args)
+}
+
+// enqueue ставит задачу в очередь. Если q — транзакция, задача появится,
+// только когда транзакция будет зафиксирована.
+func (k jobKind[T]) enqueue(q querier, args T, opts enqueueOptions) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	runAt := sql.NullTime{Time: opts.RunAt, Valid: !opts.RunAt.IsZero()}
+	_, err = q.Exec(`
+		INSERT INTO jobs (kind, args, unique_key, run_at, max_attempts)
+		VALUES ($1, $2, NULLIF($3, ''), COALESCE($4, now()), $5)
+		ON CONFLICT (kind, unique_key) WHERE unique_key IS NOT NULL AND status = 'queued' DO NOTHING
+	`, k.name, data, opts.UniqueKey, runAt, jobDefinitions[k.name].opts.MaxAttempts)
+	return err
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// permanentJobError помечает ошибку, после которой повторять задачу бесполезно.
+func permanentJobError(err error) error {
+	return permanentError{err: err}
+}
+
+// jobBackoff — пауза перед следующей попыткой после attempts неудачных, с разбросом до 10%.
+func jobBackoff(attempts int) time.Duration {
+	d := time.Duration(float64(jobBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if d > jobMaxBackoff || d <= 0 {
+		d = jobMaxBackoff
+	}
+	return d + time.Duration(mathrand.Int64N(int64(d/10)+1))
+}
+
+type claimedJob struct {
+	id          int64
+	def         *jobDefinition
+	args        json.RawMessage
+	attempts    int
+	maxAttempts int
+}
+
+// jobRunner забирает из jobs задачи, которым пора, и выполняет их.
+// Несколько экземпляров бэкенда берут разные задачи благодаря SKIP LOCKED.
+type jobRunner struct {
+	workers int
+	poll    time.Duration
+
+	mu      sync.Mutex
+	running map[string]int
+	total   int
+
+	wg sync.WaitGroup
+	// Отменяется, если при остановке задачи не успели завершиться
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+	stopped    chan struct{}
+}
+
+// startJobRunner запускает опрос очереди. Новые задачи перестают браться,
+// когда ctx отменен; дождаться уже начатых можно через shutdown.
+func startJobRunner(ctx context.Context, workers int, poll time.Duration) *jobRunner {
+	r := &jobRunner{
+		workers: workers,
+		poll:    poll,
+		running: map[string]int{},
+		stopped: make(chan struct{}),
+	}
+	r.jobCtx, r.cancelJobs = context.WithCancel(context.Background())
+	go r.loop(ctx)
+	return r
+}
+
+func (r *jobRunner) loop(ctx context.Context) {
+	defer close(r.stopped)
+	ticker := time.NewTicker(r.poll)
+	defer ticker.Stop()
+
+	kinds := make([]string, 0, len(jobDefinitions))
+	for kind := range jobDefinitions {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+
+	for {
+		for _, kind := range kinds {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := r.claim(jobDefinitions[kind]); err != nil {
+				log.Printf("Ошибка получения задач %s: %v", kind, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// free — сколько еще задач этого вида узел может взять сейчас.
+func (r *jobRunner) free(def *jobDefinition) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.workers - r.total
+	if def.opts.Concurrency > 0 {
+		n = min(n, def.opts.Concurrency-r.running[def.kind])
+	}
+	return n
+}
+
+// claim берет до свободного числа задач одного вида: новые, которым пора,
+// и зависшие, чей узел не отчитался вовремя.
+func (r *jobRunner) claim(def *jobDefinition) error {
+	n := r.free(def)
+	if n <= 0 {
+		return nil
+	}
+	rows, err := db.Query(`
+		WITH due AS (
+			SELECT id FROM jobs
+			WHERE kind = $1
+			  AND ((status = 'queued' AND run_at <= now()) OR (status = 'running' AND locked_until < now()))
+			ORDER BY run_at, id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE jobs j
+		SET status = 'running', attempts = j.attempts + 1, locked_until = now() + make_interval(secs => $3)
+		FROM due
+		WHERE j.id = due.id
+		RETURNING j.id, j.args, j.attempts, j.max_attempts
+	`, def.kind, n, (def.opts.Timeout + jobLockMargin).Seconds())
+	if err != nil {
+		return err
+	}
+	var claimed []claimedJob
+	for rows.Next() {
+		j := claimedJob{def: def}
+		var args []byte
+		if err := rows.Scan(&j.id, &args, &j.attempts, &j.maxAttempts); err != nil {
+			rows.Close()
+			return err
+		}
+		j.args = json.RawMessage(args)
+		claimed = append(claimed, j)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.total += len(claimed)
+	r.running[def.kind] += len(claimed)
+	r.mu.Unlock()
+	for _, j := range claimed {
+		r.wg.Add(1)
+		go r.execute(j)
+	}
+	return nil
+}
+
+func (r *jobRunner) execute(j claimedJob) {
+	defer r.wg.Done()
+	defer func() {
+		r.mu.Lock()
+		r.total--
+		r.running[j.def.kind]--
+		r.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(r.jobCtx, j.def.opts.Timeout)
+	err := runJob(ctx, j)
+	cancel()
+
+	if err := r.finish(j, err); err != nil {
+		log.Printf("Ошибка сохранения результата задачи %s #%d: %v", j.def.kind, j.id, err)
+	}
+}
+
+// runJob выполняет обработчик; паника в нем считается ошибкой задачи.
+func runJob(ctx context.Context, j claimedJob) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Паника в задаче %s #%d: %v\n%s", j.def.kind, j.id, p, debug.Stack())
+			err = fmt.Errorf("паника: %v", p)
+		}
+	}()
+	return j.def.run(ctx, j.args)
+}
+
+// finish записывает результат. Неудачная задача возвращается в очередь с паузой,
+// пока не кончатся попытки. Задача, прерванная остановкой узла, возвращается
+// сразу, и эта попытка не считается.
+func (r *jobRunner) finish(j claimedJob, runErr error) error {
+	if runErr == nil {
+		_, err := db.Exec(`
+			UPDATE jobs SET status = 'done', finished_at = now(), locked_until = NULL, last_error = NULL
+			WHERE id = $1
+		`, j.id)
+		return err
+	}
+
+	interrupted := r.jobCtx.Err() != nil
+	if interrupted {
+		log.Printf("Задача %s #%d прервана остановкой сервера", j.def.kind, j.id)
+	} else {
+		log.Printf("Ошибка задачи %s #%d (попытка %d из %d): %v", j.def.kind, j.id, j.attempts, j.maxAttempts, runErr)
+	}
+	var permanent permanentError
+	if !interrupted && (errors.As(runErr, &permanent) || j.attempts >= j.maxAttempts) {
+		_, err := db.Exec(`
+			UPDATE jobs SET status = 'failed', finished_at = now(), locked_until = NULL, last_error = $2
+			WHERE id = $1
+		`, j.id, runErr.Error())
+		return err
+	}
+
+	delay, attempts := jobBackoff(j.attempts), j.attempts
+	if interrupted {
+		delay, attempts = 0, j.attempts-1
+	}
+	// Если за это время в очередь встала такая же уникальная задача,
+	// работу сделает она, а эта завершается неудачей
+	_, err := db.Exec(`
+		UPDATE jobs j
+		SET status = CASE WHEN s.superseded THEN 'failed' ELSE 'queued' END,
+		    finished_at = CASE WHEN s.superseded THEN now() END,
+		    run_at = now() + make_interval(secs => $2), attempts = $3,
+		    locked_until = NULL, last_error = $4
+		FROM (
+		    SELECT EXISTS (
+		        SELECT 1 FROM jobs o JOIN jobs cur ON cur.id = $1
+		        WHERE o.kind = cur.kind AND o.unique_key = cur.unique_key AND o.status = 'queued'
+		    ) AS superseded
+		) s
+		WHERE j.id = $1
+	`, j.id, delay.Seconds(), attempts, runErr.Error())
+	return err
+}
+
+// shutdown ждет, пока завершатся начатые задачи. Опрос очереди к этому моменту
+// должен быть остановлен отменой контекста из startJobRunner. Если ctx истекает
+// раньше, задачи отменяются и возвращаются в очередь.
+func (r *jobRunner) shutdown(ctx context.Context) error {
+	<-r.stopped
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		r.cancelJobs()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// cleanupJobs удаляет завершенные задачи старше retention.
+func cleanupJobs(retention time.Duration) (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM jobs
+		WHERE status IN ('done', 'failed') AND finished_at < now() - make_interval(secs => $1)
+	`, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Аргументы проходят через очередь как JSON. Целые числа в данных уведомления
+// должны дойти до шаблона целыми.
+func TestJobArgsKeepIntegers(t *testing.T) {
+	var got deliverNotificationArgs
+	kind := defineJob("test.notification_args", jobOptions{}, func(_ context.Context, args deliverNotificationArgs) error {
+		got = args
+		return nil
+	})
+	defer delete(jobDefinitions, kind.name)
+
+	sent := deliverNotificationArgs{
+		UserID:  "8f0c6a9e-3b1d-4c1e-9a57-1f6c0b2d3e4f",
+		Kind:    notifyOrderStatus,
+		Channel: channelEmail,
+		Data:    map[string]any{"order_id": 1234567, "status_title": "подтвержден"},
+	}
+	raw, err := json.Marshal(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jobDefinitions[kind.name].run(context.Background(), raw); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	var title strings.Builder
+	if err := notificationKinds[notifyOrderStatus].title.Execute(&title, got.Data); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Заказ №1234567 подтвержден"; title.String() != want {
+		t.Errorf("заголовок = %q, нужно %q", title.String(), want)
+	}
+
+	// Данные уходят клиенту в поле data тоже целыми
+	data, err := marshalNotificationData(got.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"order_id":1234567`) {
+		t.Errorf("data = %s", data)
+	}
+}
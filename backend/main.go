@@ -2,10 +2,18 @@ package main
 
 import (
 
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
     "time" // Для работы с временем
     "log"
+    "net"
     "net/http"
+    "os"
+    "os/signal"
+    "syscall"
     "github.com/google/uuid"
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
@@ -23,6 +31,24 @@ type Apartment struct {
 	Bedrooms     int     `json:"bedrooms"`
 	Price        float64 `json:"price"`
 	Favourite    bool    `json:"favourite"`
+	Version      int     `json:"version"` // растет при каждом изменении, отдается как ETag
+	HostID       *string `json:"host_id"` // хозяин, которому пишут гости
+}
+
+const apartmentColumns = "id, title, address, image_link, description, square_meters, bedrooms, price, favourite, version, host_id"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanApartment(row rowScanner, a *Apartment, extra ...any) error {
+	var hostID sql.NullString
+	dest := append([]any{&a.ID, &a.Title, &a.Address, &a.ImageLink, &a.Description, &a.SquareMeters, &a.Bedrooms, &a.Price, &a.Favourite, &a.Version, &hostID}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	a.HostID = nullStringPtr(hostID)
+	return nil
 }
 
 type CartItem struct {
@@ -40,11 +66,14 @@ var db *sql.DB
 
 func initDB() {
 	var err error
-	connStr := "host=localhost port=5432 user=postgres password=1111 dbname=apartments_db sslmode=disable"
-	db, err = sql.Open("postgres", connStr)
+	db, err = sql.Open("postgres", config.connString())
 	if err != nil {
 		log.Fatalf("Ошибка подключения к базе данных: %v", err)
 	}
+	db.SetMaxOpenConns(config.Database.MaxOpenConns)
+	db.SetMaxIdleConns(config.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(config.Database.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.Database.ConnMaxIdleTime)
 
 	err = db.Ping()
 	if err != nil {
@@ -57,7 +86,7 @@ func getOrdersHandler(c *gin.Context) {
     userID := c.Param("user_id")
 
     rows, err := db.Query(`
-        SELECT o.id, o.total_price, o.created_at,
+        SELECT o.id, o.total_price, o.created_at, o.status, o.version, o.check_in::text, o.check_out::text,
                json_agg(json_build_object(
                    'apartment_id', oi.apartment_id,
                    'quantity', oi.quantity,
@@ -82,9 +111,12 @@ func getOrdersHandler(c *gin.Context) {
         var id int
         var totalPrice float64
         var createdAt string
+        var status string
+        var version int
+        var checkIn, checkOut sql.NullString
         var items string
 
-        if err := rows.Scan(&id, &totalPrice, &createdAt, &items); err != nil {
+        if err := rows.Scan(&id, &totalPrice, &createdAt, &status, &version, &checkIn, &checkOut, &items); err != nil {
             log.Println("Ошибка обработки строки:", err)
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки данных заказа"})
             return
@@ -94,6 +126,10 @@ func getOrdersHandler(c *gin.Context) {
             "id":          id,
             "total_price": totalPrice,
             "created_at":  createdAt,
+            "status":      status,
+            "version":     version,
+            "check_in":    nullStringPtr(checkIn),
+            "check_out":   nullStringPtr(checkOut),
             "items":       items,
         })
     }
@@ -101,56 +137,8 @@ func getOrdersHandler(c *gin.Context) {
     c.JSON(http.StatusOK, orders)
 }
 
-func createChatHandler(c *gin.Context) {
-    var request struct {
-        Participants []string `json:"participants"` // Участники чата
-    }
-
-    if err := c.ShouldBindJSON(&request); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
-        return
-    }
-
-    chatID := uuid.New()
-    query := `INSERT INTO chats (id, participants) VALUES ($1, $2)`
-    _, err := db.Exec(query, chatID, pq.Array(request.Participants))
-
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
-        return
-    }
-
-    c.JSON(http.StatusOK, gin.H{"message": "Чат создан", "chat_id": chatID})
-}
-func sendMessageHandler(c *gin.Context) {
-	var request struct {
-		ChatID   string `json:"chat_id"`
-		SenderID string `json:"sender_id"`
-		Message  string `json:"message"`
-	}
-
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
-		return
-	}
-
-	query := `
-		INSERT INTO messages (id, chat_id, sender_id, message, timestamp)
-		VALUES ($1, $2, $3, $4, $5)
-	`
-	messageID := uuid.New().String() // Генерация нового уникального идентификатора для сообщения
-	_, err := db.Exec(query, messageID, request.ChatID, request.SenderID, request.Message, time.Now().Unix())
-	if err != nil {
-		log.Println("Ошибка при добавлении сообщения:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки сообщения"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Сообщение отправлено"})
-}
-
 func getApartmentsHandler(c *gin.Context) {
-	rows, err := db.Query("SELECT id, title, address, image_link, description, square_meters, bedrooms, price, favourite FROM apartments")
+	rows, err := db.Query("SELECT " + apartmentColumns + " FROM apartments WHERE deleted_at IS NULL")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения данных"})
 		return
@@ -160,7 +148,7 @@ func getApartmentsHandler(c *gin.Context) {
 	var apartments []Apartment
 	for rows.Next() {
 		var a Apartment
-		if err := rows.Scan(&a.ID, &a.Title, &a.Address, &a.ImageLink, &a.Description, &a.SquareMeters, &a.Bedrooms, &a.Price, &a.Favourite); err != nil {
+		if err := scanApartment(rows, &a); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки данных"})
 			return
 		}
@@ -177,18 +165,53 @@ func createApartmentHandler(c *gin.Context) {
 		return
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при добавлении квартиры"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Хозяином становится тот, кто разместил квартиру. Назначить другого
+	// может только администратор
+	hostID := currentUserID(c)
+	if newApartment.HostID != nil && *newApartment.HostID != hostID {
+		if c.GetString("role") != "admin" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Назначить другого хозяина может только администратор"})
+			return
+		}
+		if _, err := uuid.Parse(*newApartment.HostID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный host_id"})
+			return
+		}
+		hostID = *newApartment.HostID
+	}
+
 	query := `
-		INSERT INTO apartments (title, address, image_link, description, square_meters, bedrooms, price, favourite)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		RETURNING id
+		INSERT INTO apartments (title, address, image_link, description, square_meters, bedrooms, price, favourite, host_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, '')::uuid)
+		RETURNING id, version, host_id
 	`
-	err := db.QueryRow(query, newApartment.Title, newApartment.Address, newApartment.ImageLink, newApartment.Description,
-		newApartment.SquareMeters, newApartment.Bedrooms, newApartment.Price, newApartment.Favourite).Scan(&newApartment.ID)
+	var host sql.NullString
+	err = tx.QueryRow(query, newApartment.Title, newApartment.Address, newApartment.ImageLink, newApartment.Description,
+		newApartment.SquareMeters, newApartment.Bedrooms, newApartment.Price, newApartment.Favourite, hostID).Scan(&newApartment.ID, &newApartment.Version, &host)
+	newApartment.HostID = nullStringPtr(host)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при добавлении квартиры"})
 		return
 	}
 
+	if err := recordApartmentRevision(tx, revisionCreate, currentUserID(c), nil, nil, &newApartment); err != nil {
+		log.Println("Ошибка записи истории квартиры:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при добавлении квартиры"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при добавлении квартиры"})
+		return
+	}
+
 	c.JSON(http.StatusOK, newApartment)
 }
 
@@ -196,8 +219,8 @@ func getApartmentByIDHandler(c *gin.Context) {
 	id := c.Param("id")
 
 	var apartment Apartment
-	query := "SELECT id, title, address, image_link, description, square_meters, bedrooms, price, favourite FROM apartments WHERE id = $1"
-	err := db.QueryRow(query, id).Scan(&apartment.ID, &apartment.Title, &apartment.Address, &apartment.ImageLink, &apartment.Description, &apartment.SquareMeters, &apartment.Bedrooms, &apartment.Price, &apartment.Favourite)
+	query := "SELECT " + apartmentColumns + " FROM apartments WHERE id = $1 AND deleted_at IS NULL"
+	err := scanApartment(db.QueryRow(query, id), &apartment)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
 		return
@@ -206,44 +229,23 @@ func getApartmentByIDHandler(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, apartment)
-}
-
-
-func updateApartmentHandler(c *gin.Context) {
-	id := c.Param("id")
-
-	var updatedFields Apartment
-	if err := c.ShouldBindJSON(&updatedFields); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
-		return
-	}
-
-	query := `
-		UPDATE apartments
-		SET title = COALESCE(NULLIF($1, ''), title),
-		    address = COALESCE(NULLIF($2, ''), address),
-		    image_link = COALESCE(NULLIF($3, ''), image_link),
-		    description = COALESCE(NULLIF($4, ''), description),
-		    square_meters = COALESCE(NULLIF($5::int, 0), square_meters),
-		    bedrooms = COALESCE(NULLIF($6::int, 0), bedrooms),
-		    price = COALESCE(NULLIF($7::numeric, 0), price),
-		    favourite = COALESCE($8, favourite)
-		WHERE id = $9
-	`
-	_, err := db.Exec(query, updatedFields.Title, updatedFields.Address, updatedFields.ImageLink, updatedFields.Description,
-		updatedFields.SquareMeters, updatedFields.Bedrooms, updatedFields.Price, updatedFields.Favourite, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при обновлении данных"})
+	etag := versionETag(apartment.Version)
+	if notModified(c, etag) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Квартира обновлена"})
+	c.Header("ETag", etag)
+	c.JSON(http.StatusOK, apartment)
 }
+
+
 func createOrderHandler(c *gin.Context) {
     var order struct {
         UserID string     `json:"user_id"`
         Items  []CartItem `json:"items"`
+        // Даты проживания в формате 2006-01-02, необязательны
+        CheckIn  string `json:"check_in"`
+        CheckOut string `json:"check_out"`
     }
 
     if err := c.ShouldBindJSON(&order); err != nil {
@@ -252,6 +254,26 @@ func createOrderHandler(c *gin.Context) {
         return
     }
 
+    var checkIn, checkOut sql.NullTime
+    for _, d := range []struct {
+        value string
+        dest  *sql.NullTime
+    }{{order.CheckIn, &checkIn}, {order.CheckOut, &checkOut}} {
+        if d.value == "" {
+            continue
+        }
+        t, err := time.Parse(time.DateOnly, d.value)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Даты должны быть в формате ГГГГ-ММ-ДД"})
+            return
+        }
+        *d.dest = sql.NullTime{Time: t, Valid: true}
+    }
+    if checkIn.Valid && checkOut.Valid && !checkOut.Time.After(checkIn.Time) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Дата выезда должна быть позже даты заезда"})
+        return
+    }
+
     log.Printf("Создание заказа для пользователя: %s", order.UserID)
 
     // Рассчитываем общую стоимость
@@ -260,10 +282,18 @@ func createOrderHandler(c *gin.Context) {
         totalPrice += item.Price * float64(item.Quantity)
     }
 
+    // Заказ, его состав, событие для партнеров и очистка корзины сохраняются вместе
+    tx, err := db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания заказа"})
+        return
+    }
+    defer tx.Rollback()
+
     // Создание записи заказа
     var orderID int
-    query := `INSERT INTO orders (user_id, total_price) VALUES ($1, $2) RETURNING id`
-    err := db.QueryRow(query, order.UserID, totalPrice).Scan(&orderID)
+    query := `INSERT INTO orders (user_id, total_price, check_in, check_out) VALUES ($1, $2, $3, $4) RETURNING id`
+    err = tx.QueryRow(query, order.UserID, totalPrice, checkIn, checkOut).Scan(&orderID)
     if err != nil {
         log.Println("Ошибка создания заказа:", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания заказа"})
@@ -273,7 +303,7 @@ func createOrderHandler(c *gin.Context) {
     // Добавляем элементы заказа
     for _, item := range order.Items {
         query = `INSERT INTO order_items (order_id, apartment_id, quantity) VALUES ($1, $2, $3)`
-        _, err = db.Exec(query, orderID, item.ApartmentID, item.Quantity)
+        _, err = tx.Exec(query, orderID, item.ApartmentID, item.Quantity)
         if err != nil {
             log.Println("Ошибка добавления элементов заказа:", err)
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка добавления элементов заказа"})
@@ -281,10 +311,28 @@ func createOrderHandler(c *gin.Context) {
         }
     }
 
-    // Очищаем корзину пользователя
-    _, err = db.Exec("DELETE FROM cart WHERE user_id = $1", order.UserID)
+    if err := enqueueOrderEvent(tx, outboxOrderCreated, orderID); err != nil {
+        log.Println("Ошибка записи события заказа:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания заказа"})
+        return
+    }
+
+    // Из корзины убирается только то, что попало в заказ: добавленное
+    // во время оформления остается
+    _, err = tx.Exec(`
+        DELETE FROM cart
+        WHERE user_id = $1 AND apartment_id IN (SELECT apartment_id FROM order_items WHERE order_id = $2)
+    `, order.UserID, orderID)
     if err != nil {
         log.Println("Ошибка очистки корзины:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания заказа"})
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        log.Println("Ошибка создания заказа:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания заказа"})
+        return
     }
 
     c.JSON(http.StatusOK, gin.H{"message": "Заказ успешно создан", "order_id": orderID})
@@ -335,19 +383,33 @@ func addToCartHandler(c *gin.Context) {
 
     log.Printf("Полученные данные: %+v\n", item)
 
+    // Удаленные квартиры добавить в корзину нельзя
+    var apartmentExists bool
+    err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM apartments WHERE id = $1 AND deleted_at IS NULL)", item.ApartmentID).Scan(&apartmentExists)
+    if err != nil {
+        log.Println("Ошибка проверки квартиры:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки квартиры"})
+        return
+    }
+    if !apartmentExists {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+        return
+    }
+
     // Проверка существования пользователя
     var userExists bool
-    err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", item.UserID).Scan(&userExists)
+    err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", item.UserID).Scan(&userExists)
     if err != nil {
         log.Println("Ошибка проверки пользователя:", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки пользователя"})
         return
     }
 
-    // Автоматическое добавление пользователя, если его нет
+    // Автоматическое добавление пользователя, если его нет.
+    // Почту не придумываем: пустой адрес значит, что писем он не получает
     if !userExists {
-        _, err := db.Exec("INSERT INTO users (id, name, email) VALUES ($1, $2, $3)",
-            item.UserID, "Новый пользователь", "default@example.com")
+        _, err := db.Exec("INSERT INTO users (id, name, email) VALUES ($1, $2, '')",
+            item.UserID, "Новый пользователь")
         if err != nil {
             log.Println("Ошибка создания пользователя:", err)
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания пользователя"})
@@ -360,7 +422,7 @@ func addToCartHandler(c *gin.Context) {
     query := `
         INSERT INTO cart (apartment_id, user_id, quantity)
         VALUES ($1, $2, $3)
-        ON CONFLICT (apartment_id, user_id) DO UPDATE SET quantity = cart.quantity + $3
+        ON CONFLICT (apartment_id, user_id) DO UPDATE SET quantity = cart.quantity + $3, updated_at = now()
         RETURNING id, apartment_id, user_id, quantity
     `
     err = db.QueryRow(query, item.ApartmentID, item.UserID, item.Quantity).Scan(
@@ -393,39 +455,170 @@ func removeFromCartHandler(c *gin.Context) {
 }
 
 
+// Квартира не удаляется физически: на нее ссылаются старые заказы,
+// поэтому она только помечается удаленной и пропадает из каталога.
+// Удалить квартиру может ее хозяин или администратор.
 func deleteApartmentHandler(c *gin.Context) {
 	id := c.Param("id")
 
-	query := "DELETE FROM apartments WHERE id = $1"
-	_, err := db.Exec(query, id)
-	if err != nil {
+	versions := ifMatchVersions(c)
+	_, err := changeOwnApartment(c, id, revisionDelete, func(tx *sql.Tx) (*Apartment, error) {
+		var a Apartment
+		err := scanApartment(tx.QueryRow(`
+			UPDATE apartments
+			SET deleted_at = now(), version = version + 1
+			WHERE id = $1 AND deleted_at IS NULL
+			  AND ($2::bigint[] IS NULL OR version = ANY($2::bigint[]))
+			RETURNING `+apartmentColumns, id, pq.Array(versions)), &a)
+		if err != nil {
+			return nil, err
+		}
+
+		// В корзинах удаленной квартире делать нечего
+		_, err = tx.Exec("DELETE FROM cart WHERE apartment_id = $1", id)
+		return &a, err
+	})
+	if err == sql.ErrNoRows {
+		respondApartmentMiss(c, id, versions)
+		return
+	} else if err == errApartmentNotOwned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка при удалении квартиры:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка при удалении квартиры"})
 		return
 	}
 
-	c.JSON(http.StatusNoContent, gin.H{"message": "Квартира удалена"})
+	c.Status(http.StatusNoContent)
 }
 
-func toggleFavouriteHandler(c *gin.Context) {
+// Список удаленных квартир, которые еще можно восстановить
+func getDeletedApartmentsHandler(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT id, title, address, image_link, description, square_meters, bedrooms, price, favourite, version, deleted_at
+		FROM apartments
+		WHERE deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения данных"})
+		return
+	}
+	defer rows.Close()
+
+	apartments := []gin.H{}
+	for rows.Next() {
+		var a Apartment
+		var deletedAt time.Time
+		if err := rows.Scan(&a.ID, &a.Title, &a.Address, &a.ImageLink, &a.Description, &a.SquareMeters, &a.Bedrooms, &a.Price, &a.Favourite, &a.Version, &deletedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки данных"})
+			return
+		}
+		apartments = append(apartments, gin.H{"apartment": a, "deleted_at": deletedAt})
+	}
+
+	c.JSON(http.StatusOK, apartments)
+}
+
+func restoreApartmentHandler(c *gin.Context) {
 	id := c.Param("id")
 
 	query := `
 		UPDATE apartments
-		SET favourite = NOT favourite
-		WHERE id = $1
-	`
-	_, err := db.Exec(query, id)
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING ` + apartmentColumns
+	apartment, err := changeApartment(id, revisionRestore, currentUserID(c), nil, func(tx *sql.Tx) (*Apartment, error) {
+		var a Apartment
+		err := scanApartment(tx.QueryRow(query, id), &a)
+		return &a, err
+	})
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Удаленная квартира не найдена"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка восстановления квартиры:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка восстановления квартиры"})
+		return
+	}
+
+	c.Header("ETag", versionETag(apartment.Version))
+	c.JSON(http.StatusOK, apartment)
+}
+
+// Корзина, которую не меняли столько времени, считается брошенной
+const cartRetention = 30 * 24 * time.Hour
+
+// purgeExpiredCarts удаляет из корзин позиции, которые давно не менялись.
+func purgeExpiredCarts(retention time.Duration) (int64, error) {
+	result, err := db.Exec("DELETE FROM cart WHERE updated_at < now() - make_interval(secs => $1)", retention.Seconds())
 	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Сколько хранятся удаленные квартиры, прежде чем их можно стереть окончательно
+const apartmentRetention = 30 * 24 * time.Hour
+
+// purgeDeletedApartments окончательно удаляет квартиры, удаленные раньше срока
+// хранения. Квартиры, на которые ссылаются заказы или чаты, остаются навсегда:
+// без квартиры чат пары слился бы с ее общим чатом и нарушил уникальный индекс.
+func purgeDeletedApartments(retention time.Duration) (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM apartments a
+		WHERE a.deleted_at IS NOT NULL
+		  AND a.deleted_at < now() - make_interval(secs => $1)
+		  AND NOT EXISTS (SELECT 1 FROM order_items oi WHERE oi.apartment_id = a.id)
+		  AND NOT EXISTS (SELECT 1 FROM chats ch WHERE ch.apartment_id = a.id)
+	`, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Флаг избранного хранится в самой квартире, поэтому переключает его хозяин или администратор.
+func toggleFavouriteHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	query := `
+		UPDATE apartments
+		SET favourite = NOT favourite, version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL
+		  AND ($2::bigint[] IS NULL OR version = ANY($2::bigint[]))
+		RETURNING ` + apartmentColumns
+	versions := ifMatchVersions(c)
+	apartment, err := changeOwnApartment(c, id, revisionUpdate, func(tx *sql.Tx) (*Apartment, error) {
+		var a Apartment
+		err := scanApartment(tx.QueryRow(query, id, pq.Array(versions)), &a)
+		return &a, err
+	})
+	if err == sql.ErrNoRows {
+		respondApartmentMiss(c, id, versions)
+		return
+	} else if err == errApartmentNotOwned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка обновления статуса избранного:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления статуса избранного"})
 		return
 	}
 
+	c.Header("ETag", versionETag(apartment.Version))
 	c.JSON(http.StatusOK, gin.H{"message": "Статус избранного обновлен"})
 }
-// Функция для создания чата или получения существующего
+// Функция для создания чата или получения существующего.
+// Пара участников хранится в отсортированном виде, поэтому у любой пары
+// ровно один чат на квартиру и заказ, а уникальный индекс не дает создать второй при гонке запросов.
+// Создать можно только чат, в котором участвует сам пользователь.
 func createOrGetChatHandler(c *gin.Context) {
 	var request struct {
 		Participants []string `json:"participants"` // Участники чата
+		ApartmentID  *int     `json:"apartment_id"` // Необязательно: квартира, о которой идет речь
+		OrderID      *int     `json:"order_id"`     // Необязательно: бронирование
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -434,124 +627,302 @@ func createOrGetChatHandler(c *gin.Context) {
 		return
 	}
 
-	// ID, которые должны быть "привязаны"
-	const userA = "317ea524-9e31-44ec-a075-fb2d2aff8d54"
-	const userB = "a64e3a3b-dc64-40ec-bbb5-090b2abef034"
-
-	// Логика подстановки:
-	var participantA, participantB string
-
-	if request.Participants[0] == userA {
-		participantA = userA
-		participantB = userB
-	} else {
-		participantA = request.Participants[0]
-		participantB = userA
+	// Достаточно указать собеседника, текущий пользователь добавляется сам
+	userID := currentUserID(c)
+	if len(request.Participants) == 1 {
+		request.Participants = append(request.Participants, userID)
 	}
-
-	// Проверяем существующий чат
-	var chatID string
-	query := `SELECT id FROM chats WHERE participants @> $1 LIMIT 1`
-    err := db.QueryRow(query, pq.Array([]string{participantA, participantB})).Scan(&chatID)
-
-	if err == nil {
-		// Чат уже существует
-		c.JSON(http.StatusOK, gin.H{"message": "Чат найден", "chat_id": chatID})
+	participants, err := canonicalParticipants(request.Participants)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if participants[0] != userID && participants[1] != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Можно создать только чат, в котором вы участвуете"})
 		return
 	}
 
-	// Ошибка кроме ErrNoRows
-	if err != nil && err != sql.ErrNoRows {
-		log.Println("Ошибка при проверке существования чата:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки чатов"})
+	missing, err := missingUsers(participants)
+	if err != nil {
+		log.Println("Ошибка проверки участников:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка проверки участников"})
+		return
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден", "user_ids": missing})
 		return
 	}
 
-	// Чат не найден - создаем новый
-	chatID = uuid.New().String()
-	query = `INSERT INTO chats (id, participants) VALUES ($1, $2)`
-	_, err = db.Exec(query, chatID, pq.Array([]string{participantA, participantB}))
+	var apartmentID, orderID sql.NullInt64
+	if request.ApartmentID != nil {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM apartments WHERE id = $1 AND deleted_at IS NULL)", *request.ApartmentID).Scan(&exists); err != nil {
+			log.Println("Ошибка проверки квартиры:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+			return
+		}
+		apartmentID = sql.NullInt64{Int64: int64(*request.ApartmentID), Valid: true}
+	}
+	if request.OrderID != nil {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM orders WHERE id = $1)", *request.OrderID).Scan(&exists); err != nil {
+			log.Println("Ошибка проверки заказа:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Заказ не найден"})
+			return
+		}
+		orderID = sql.NullInt64{Int64: int64(*request.OrderID), Valid: true}
+	}
+
+	// Создаем чат, а если пара уже общается по этой квартире и заказу — берем существующий
+	chatID, created, err := openChat(db, participants, apartmentID, orderID)
 	if err != nil {
 		log.Println("Ошибка при создании чата:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания чата"})
 		return
 	}
+	if created {
+		log.Printf("Создан новый чат: %s между %s и %s", chatID, participants[0], participants[1])
+		c.JSON(http.StatusOK, gin.H{"message": "Чат создан", "chat_id": chatID})
+		return
+	}
 
-	log.Printf("Создан новый чат: %s между %s и %s", chatID, participantA, participantB)
-	c.JSON(http.StatusOK, gin.H{"message": "Чат создан", "chat_id": chatID})
+	c.JSON(http.StatusOK, gin.H{"message": "Чат найден", "chat_id": chatID})
 }
 
-func getMessagesHandler(c *gin.Context) {
-   chatID := c.Param("chat_id")
-    log.Printf("Получен запрос на получение сообщений для chat_id: %s", chatID)
-
-    if chatID == "" {
-        log.Println("Ошибка: chat_id отсутствует в запросе")
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Missing chat_id"})
-        return
-    }
+// canonicalParticipants проверяет пару участников и приводит ее к единому виду:
+// UUID в нижнем регистре, отсортированные по возрастанию.
+func canonicalParticipants(ids []string) ([]string, error) {
+	if len(ids) != 2 {
+		return nil, errors.New("В чате должно быть ровно два участника")
+	}
 
-    // Проверяем наличие сообщений
-    log.Println("Выполняем SQL-запрос для получения сообщений")
-    rows, err := db.Query("SELECT sender_id, message, created_at FROM messages WHERE chat_id = $1 ORDER BY created_at", chatID)
-    if err != nil {
-        log.Printf("Ошибка при выполнении SQL-запроса: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error querying messages"})
-        return
-    }
-    defer rows.Close()
+	participants := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return nil, fmt.Errorf("Некорректный идентификатор участника: %q", id)
+		}
+		participants = append(participants, parsed.String())
+	}
+	if participants[0] == participants[1] {
+		return nil, errors.New("Нельзя создать чат с самим собой")
+	}
 
-    var messages []map[string]interface{}
-    for rows.Next() {
-        var senderID, message string
-        var createdAt time.Time
-        if err := rows.Scan(&senderID, &message, &createdAt); err != nil {
-            log.Printf("Ошибка при сканировании строки: %v", err)
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning messages"})
-            return
-        }
-        messages = append(messages, map[string]interface{}{
-            "sender_id": senderID,
-            "message":   message,
-            "created_at": createdAt,
-        })
-    }
+	sort.Strings(participants)
+	return participants, nil
+}
 
-    if len(messages) == 0 {
-        log.Printf("Для chat_id=%s сообщений не найдено", chatID)
-        c.JSON(http.StatusNotFound, gin.H{"error": "Messages not found"})
-        return
-    }
+// missingUsers возвращает идентификаторы, которых нет в таблице users.
+func missingUsers(ids []string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT p FROM unnest($1::uuid[]) AS p
+		WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.id = p)
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-    log.Printf("Отправляем %d сообщений для chat_id=%s", len(messages), chatID)
-    c.JSON(http.StatusOK, messages)
+	missing := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		missing = append(missing, id)
+	}
+	return missing, rows.Err()
 }
 
-
 func main() {
+	initConfig()
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 
+	config.log()
 	initDB()
+	if config.Database.AutoMigrate {
+		if _, err := migrateUp(context.Background()); err != nil {
+			log.Fatalf("Ошибка миграции базы данных: %v", err)
+		}
+	}
+	initModeration()
+	initNotifications()
+
+	// В одном экземпляре события раздаются в памяти, в нескольких — через PostgreSQL
+	var broker Broker = &memoryBroker{}
+	if config.Realtime.Backend == "postgres" {
+		broker = &pgBroker{connStr: config.connString()}
+	}
+	var err error
+	if hub, err = newHub(broker); err != nil {
+		log.Fatalf("Не удалось запустить рассылку событий: %v", err)
+	}
+
+	storage = &localStorage{root: config.Attachments.Dir}
 
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: accessLogFormatter}), gin.Recovery())
+	r.Use(authOptional())
 
 
 
 	r.GET("/apartments", getApartmentsHandler)
-	r.POST("/apartments/create", createApartmentHandler)
+	r.POST("/apartments/create", authRequired(), createApartmentHandler)
 	r.GET("/apartments/:id", getApartmentByIDHandler)
-	r.PUT("/apartments/update/:id", updateApartmentHandler)
-	r.DELETE("/apartments/delete/:id", deleteApartmentHandler)
-	r.PUT("/apartments/favourite/:id", toggleFavouriteHandler)
+	r.PATCH("/apartments/:id", authRequired(), patchApartmentHandler)
+	r.GET("/apartments/:id/history", authRequired(), getApartmentHistoryHandler)
+	r.GET("/apartments/:id/prices", getApartmentPriceHistoryHandler)
+	r.POST("/apartments/:id/contact", authRequired(), contactHostHandler)
+	r.DELETE("/apartments/delete/:id", authRequired(), deleteApartmentHandler)
+	r.PUT("/apartments/favourite/:id", authRequired(), toggleFavouriteHandler)
     r.GET("/cart/:user_id", getCartHandler)
     r.POST("/cart", addToCartHandler)
     r.DELETE("/cart/:user_id/:apartment_id", removeFromCartHandler)
     r.POST("/orders", createOrderHandler)
     r.GET("/orders/:user_id", getOrdersHandler)
+	r.PUT("/orders/status/:id", authRequired(), updateOrderStatusHandler)
           // Создать чат
-    r.POST("/messages", sendMessageHandler)    // Отправить сообщение
-    r.GET("/messages/:chat_id", getMessagesHandler) // Получить сообщения
-    r.POST("/chats", createOrGetChatHandler)
+    r.POST("/messages", authRequired(), sendMessageHandler)    // Отправить сообщение
+    r.GET("/messages/:chat_id", authRequired(), getMessagesHandler) // Получить сообщения
+	r.PATCH("/messages/:message_id", authRequired(), editMessageHandler)
+	r.DELETE("/messages/:message_id", authRequired(), deleteMessageHandler)
+	r.POST("/messages/:message_id/report", authRequired(), reportMessageHandler)
+	r.GET("/search/messages", authRequired(), searchMessagesHandler)
+    r.POST("/chats", authRequired(), createOrGetChatHandler)
+	r.GET("/chats", authRequired(), getChatsHandler)
+	r.POST("/chats/groups", authRequired(), createGroupChatHandler)
+	r.PATCH("/chats/:chat_id", authRequired(), renameChatHandler)
+	r.POST("/chats/:chat_id/members", authRequired(), addChatMembersHandler)
+	r.DELETE("/chats/:chat_id/members/:user_id", authRequired(), removeChatMemberHandler)
+	r.PUT("/chats/:chat_id/members/:user_id/role", authRequired(), setChatMemberRoleHandler)
+	r.POST("/chats/:chat_id/leave", authRequired(), removeChatMemberHandler)
+	r.POST("/chats/:chat_id/delivered", authRequired(), acknowledgeHandler(receiptDelivered))
+	r.POST("/chats/:chat_id/read", authRequired(), acknowledgeHandler(receiptRead))
+	r.POST("/chats/:chat_id/typing", authRequired(), typingHandler)
+	// Без ключа подписи ссылку на любой файл мог бы подделать кто угодно
+	if len(attachmentSigningKey()) > 0 {
+		r.POST("/chats/:chat_id/attachments", authRequired(), uploadAttachmentHandler)
+		r.GET("/attachments/:id", downloadAttachmentHandler)
+		r.GET("/attachments/:id/link", authRequired(), attachmentLinkHandler)
+	} else {
+		log.Println("ОШИБКА: не заданы ATTACHMENT_URL_SECRET и SUPABASE_JWT_SECRET, вложения отключены")
+	}
+	r.GET("/ws", queryToken(), authRequired(), websocketHandler)
+	r.GET("/events", queryToken(), authRequired(), eventsStreamHandler)
+	r.GET("/users/me/privacy", authRequired(), getPrivacyHandler)
+	r.PUT("/users/me/privacy", authRequired(), updatePrivacyHandler)
+
+	notifications := r.Group("/notifications", authRequired())
+	notifications.GET("", getNotificationsHandler)
+	notifications.POST("/:id/read", markNotificationReadHandler)
+	notifications.POST("/read_all", markAllNotificationsReadHandler)
+	notifications.GET("/preferences", getNotificationPreferencesHandler)
+	notifications.PUT("/preferences", updateNotificationPreferencesHandler)
+	notifications.POST("/devices", registerPushDeviceHandler)
+	notifications.DELETE("/devices/:token", unregisterPushDeviceHandler)
+	r.GET("/users/:user_id/presence", authRequired(), getUserPresenceHandler)
+
+	admin := r.Group("/admin", authRequired(), adminRequired())
+	admin.GET("/apartments/deleted", getDeletedApartmentsHandler)
+	admin.PUT("/apartments/restore/:id", restoreApartmentHandler)
+	admin.PUT("/apartments/:id/host", setApartmentHostHandler)
+	admin.POST("/apartments/:id/rollback/:revision_id", rollbackApartmentHandler)
+	admin.POST("/apartments/import", importApartmentsHandler)
+	admin.GET("/apartments/export", exportApartmentsHandler)
+	admin.GET("/messages/:message_id/edits", getMessageEditsHandler)
+	admin.GET("/tasks", getScheduledTasksHandler)
+	admin.GET("/tasks/:name/runs", getScheduledTaskRunsHandler)
+	admin.POST("/tasks/:name/run", runScheduledTaskHandler)
+
+	// Вебхуки для партнеров: агентства получают события по своим квартирам
+	if config.Features.Webhooks {
+		hooks := r.Group("/webhooks", authRequired(), roleRequired("partner", "admin"))
+		hooks.GET("", getWebhookEndpointsHandler)
+		hooks.POST("", createWebhookEndpointHandler)
+		hooks.PATCH("/:id", updateWebhookEndpointHandler)
+		hooks.DELETE("/:id", deleteWebhookEndpointHandler)
+		hooks.GET("/:id/deliveries", getWebhookDeliveriesHandler)
+		hooks.GET("/dead-letters", getWebhookDeadLettersHandler)
+		hooks.GET("/deliveries/:delivery_id/attempts", getWebhookAttemptsHandler)
+		hooks.POST("/deliveries/:delivery_id/replay", replayWebhookDeliveryHandler)
+	}
 
-	log.Println("Сервер запущен на порту 8080")
-	r.Run(":8080")
+	// Очередь жалоб и блокировки доступны и модераторам, и администраторам
+	mod := r.Group("/moderation", authRequired(), roleRequired("admin", "moderator"))
+	mod.GET("/reports", getReportsHandler)
+	mod.POST("/reports/:id/resolve", resolveReportHandler)
+	mod.GET("/blocks", getMessagingBlocksHandler)
+	mod.POST("/blocks", blockUserHandler)
+	mod.DELETE("/blocks/:user_id", unblockUserHandler)
+
+	go runPresence()
+
+	// По SIGINT или SIGTERM сервер перестает принимать запросы и брать задачи,
+	// дожидается начатых и только потом завершается
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var jobs *jobRunner
+	if config.Features.Jobs {
+		jobs = startJobRunner(ctx, config.Jobs.Workers, config.Jobs.PollInterval)
+	}
+	var tasks *scheduler
+	if config.Features.Scheduler {
+		tasks = startScheduler(ctx)
+	}
+
+	s := config.Server
+	srv := &http.Server{
+		Addr:              s.Addr,
+		Handler:           r,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+		// Запросы получают контекст, который отменяется при остановке:
+		// так закрываются бесконечные потоки SSE и Shutdown их не ждет
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		var err error
+		if s.TLS.CertFile != "" {
+			log.Printf("Сервер запущен на %s (HTTPS)", s.Addr)
+			err = srv.ListenAndServeTLS(s.TLS.CertFile, s.TLS.KeyFile)
+		} else {
+			log.Printf("Сервер запущен на %s", s.Addr)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("Ошибка запуска сервера:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Println("Остановка сервера...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Ошибка остановки HTTP-сервера:", err)
+	}
+	if jobs != nil {
+		if err := jobs.shutdown(shutdownCtx); err != nil {
+			log.Println("Фоновые задачи не успели завершиться и вернутся в очередь:", err)
+		}
+	}
+	if tasks != nil {
+		if err := tasks.shutdown(shutdownCtx); err != nil {
+			log.Println("Задачи по расписанию не успели завершиться:", err)
+		}
+	}
+	log.Println("Сервер остановлен")
 }
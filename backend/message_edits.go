@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Сколько времени после отправки сообщение можно удалить для всех
+const messageDeleteWindow = 48 * time.Hour
+
+// Области удаления сообщения
+const (
+	deleteForMe       = "me"
+	deleteForEveryone = "everyone"
+)
+
+// MessageEdit — прежний текст сообщения до правки.
+type MessageEdit struct {
+	ID         int64     `json:"id"`
+	OldMessage string    `json:"old_message"`
+	EditedBy   string    `json:"edited_by"`
+	EditedAt   time.Time `json:"edited_at"`
+}
+
+// lockChatMessage блокирует сообщение до конца транзакции и проверяет,
+// что пользователь состоит в его чате. Для чужих чатов возвращается sql.ErrNoRows.
+func lockChatMessage(tx *sql.Tx, messageID, userID string) (*Message, []string, error) {
+	if _, err := uuid.Parse(messageID); err != nil {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	var m Message
+	err := scanMessage(tx.QueryRow("SELECT "+messageColumns+" FROM messages WHERE id = $1 FOR UPDATE", messageID), &m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	participants, err := chatMembers(tx, m.ChatID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !slices.Contains(participants, userID) {
+		return nil, nil, sql.ErrNoRows
+	}
+	return &m, participants, nil
+}
+
+// PATCH /messages/:message_id — правка своего сообщения.
+// Прежний текст сохраняется в message_edits.
+func editMessageHandler(c *gin.Context) {
+	userID := currentUserID(c)
+
+	var request struct {
+		Message string `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	if !validMessageText(request.Message) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Сообщение должно содержать от 1 до %d символов", maxMessageLength)})
+		return
+	}
+	moderation, ok := moderateMessage(c, userID, request.Message)
+	if !ok {
+		return
+	}
+	originalText := ""
+	if moderation.Masked {
+		originalText = request.Message
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения сообщения"})
+		return
+	}
+	defer tx.Rollback()
+
+	message, participants, err := lockChatMessage(tx, c.Param("message_id"), userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения сообщения"})
+		return
+	}
+	if message.SenderID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Можно изменять только свои сообщения"})
+		return
+	}
+	if message.DeletedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Сообщение удалено"})
+		return
+	}
+	if message.Message == moderation.Text {
+		c.JSON(http.StatusOK, gin.H{"message": "Сообщение не изменилось", "data": message})
+		return
+	}
+
+	// В историю правок попадает исходный текст, а не скрытый фильтрами
+	_, err = tx.Exec(`
+		INSERT INTO message_edits (message_id, old_message, edited_by)
+		SELECT id, COALESCE(original_message, message), $2 FROM messages WHERE id = $1
+	`, message.ID, userID)
+	if err == nil {
+		err = scanMessage(tx.QueryRow(`
+			UPDATE messages SET message = $1, original_message = NULLIF($2, ''), edited_at = now()
+			WHERE id = $3
+			RETURNING `+messageColumns, moderation.Text, originalText, message.ID), message)
+	}
+	if err == nil {
+		err = flagMessage(tx, message.ID, moderation.Flags)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Ошибка изменения сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения сообщения"})
+		return
+	}
+
+	// Правка уже сохранена, поэтому без вложений отвечаем все равно успехом
+	messages := []Message{*message}
+	if err := attachAttachments(messages); err != nil {
+		log.Println("Ошибка получения вложений сообщения:", err)
+	}
+	message = &messages[0]
+
+	publishEvent(eventMessageEdited, message.ChatID, message, participants)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Сообщение изменено", "data": message})
+}
+
+// DELETE /messages/:message_id?scope=me|everyone
+// scope=me скрывает любое сообщение чата только у текущего пользователя.
+// scope=everyone удаляет свое сообщение у всех, пока не прошло messageDeleteWindow.
+func deleteMessageHandler(c *gin.Context) {
+	userID := currentUserID(c)
+
+	scope := c.DefaultQuery("scope", deleteForMe)
+	if scope != deleteForMe && scope != deleteForEveryone {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope должен быть me или everyone"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка удаления сообщения"})
+		return
+	}
+	defer tx.Rollback()
+
+	message, participants, err := lockChatMessage(tx, c.Param("message_id"), userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка удаления сообщения"})
+		return
+	}
+
+	recipients := []string{userID}
+	if scope == deleteForEveryone {
+		if message.SenderID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Удалить для всех можно только свое сообщение"})
+			return
+		}
+		if message.DeletedAt != nil {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		if time.Since(message.CreatedAt) > messageDeleteWindow {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Время, в течение которого сообщение можно удалить для всех, истекло"})
+			return
+		}
+		_, err = tx.Exec("UPDATE messages SET deleted_at = now() WHERE id = $1", message.ID)
+		recipients = participants
+	} else {
+		_, err = tx.Exec("INSERT INTO message_hidden (message_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", message.ID, userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Ошибка удаления сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка удаления сообщения"})
+		return
+	}
+
+	// При удалении только у себя событие получают другие устройства того же пользователя
+	publishEvent(eventMessageDeleted, message.ChatID, gin.H{
+		"message_id": message.ID,
+		"chat_id":    message.ChatID,
+		"seq":        message.Seq,
+		"scope":      scope,
+	}, recipients)
+
+	c.Status(http.StatusNoContent)
+}
+
+// GET /admin/messages/:message_id/edits — исходный текст сообщения и все его правки,
+// в том числе если сообщение удалено для всех.
+func getMessageEditsHandler(c *gin.Context) {
+	messageID := c.Param("message_id")
+	if _, err := uuid.Parse(messageID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+		return
+	}
+
+	var text string
+	var deletedAt sql.NullTime
+	err := db.QueryRow("SELECT COALESCE(original_message, message), deleted_at FROM messages WHERE id = $1", messageID).Scan(&text, &deletedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории сообщения"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, old_message, edited_by, edited_at
+		FROM message_edits
+		WHERE message_id = $1
+		ORDER BY id
+	`, messageID)
+	if err != nil {
+		log.Println("Ошибка получения истории сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории сообщения"})
+		return
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.ID, &e.OldMessage, &e.EditedBy, &e.EditedAt); err != nil {
+			log.Println("Ошибка обработки истории сообщения:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории сообщения"})
+			return
+		}
+		edits = append(edits, e)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка получения истории сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории сообщения"})
+		return
+	}
+
+	response := gin.H{"message_id": messageID, "message": text, "edits": edits, "deleted_at": nil}
+	if deletedAt.Valid {
+		response["deleted_at"] = deletedAt.Time
+	}
+	c.JSON(http.StatusOK, response)
+}
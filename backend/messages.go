@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Событие о сообщении уходит через NOTIFY, а его payload ограничен 8000 байтами
+const maxMessageLength = 2000
+
+const (
+	defaultMessagesPage = 50
+	maxMessagesPage     = 200
+)
+
+// Виды сообщений: системные пишет сам сервис, отправителя у них нет
+const (
+	messageKindUser   = "user"
+	messageKindSystem = "system"
+)
+
+// Message — сообщение чата. Seq растет внутри чата без пропусков и повторов
+// и служит курсором для постраничной загрузки; CreatedAt назначает сервер.
+type Message struct {
+	ID        string    `json:"id"`
+	ChatID    string    `json:"chat_id"`
+	SenderID  string    `json:"sender_id"`
+	Message   string    `json:"message"`
+	Seq       int64     `json:"seq"`
+	CreatedAt time.Time `json:"created_at"`
+	Kind      string    `json:"kind"`
+	// Данные системного сообщения для клиента, например смена статуса заказа
+	System json.RawMessage `json:"system,omitempty"`
+
+	ReplyToID *string    `json:"reply_to_id"`
+	EditedAt  *time.Time `json:"edited_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+
+	Status      string           `json:"status,omitempty"`
+	Receipts    []MessageReceipt `json:"receipts,omitempty"`
+	Attachments []Attachment     `json:"attachments,omitempty"`
+}
+
+const messageColumns = "id, chat_id, sender_id, message, seq, created_at, kind, system, reply_to_id, edited_at, deleted_at"
+
+// scanMessage читает сообщение. Текст удаленного для всех сообщения
+// остается в базе для модерации, но клиентам не отдается.
+func scanMessage(row rowScanner, m *Message, extra ...any) error {
+	var senderID, replyTo sql.NullString
+	var system []byte
+	var edited, deleted sql.NullTime
+	dest := append([]any{&m.ID, &m.ChatID, &senderID, &m.Message, &m.Seq, &m.CreatedAt, &m.Kind, &system,
+		&replyTo, &edited, &deleted}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	m.SenderID = senderID.String
+	m.System = nil
+	if system != nil {
+		m.System = json.RawMessage(system)
+	}
+	m.ReplyToID, m.EditedAt, m.DeletedAt = nil, nil, nil
+	if replyTo.Valid {
+		m.ReplyToID = &replyTo.String
+	}
+	if edited.Valid {
+		m.EditedAt = &edited.Time
+	}
+	if deleted.Valid {
+		m.DeletedAt = &deleted.Time
+		m.Message = ""
+	}
+	return nil
+}
+
+// Ответить можно только на сообщение из того же чата
+var errReplyNotFound = errors.New("сообщение, на которое дан ответ, не найдено в этом чате")
+
+// newMessage — то, что нужно для добавления сообщения в чат.
+// ReplyToID и AttachmentIDs необязательны. У системных сообщений
+// (Kind = messageKindSystem) SenderID пустой, а в System лежат данные для клиента.
+// OriginalText задается, если фильтры изменили текст: его видят только модераторы.
+type newMessage struct {
+	ChatID        string
+	SenderID      string
+	Text          string
+	OriginalText  string
+	ReplyToID     string
+	AttachmentIDs []string
+
+	Kind   string
+	System any
+}
+
+// insertMessage добавляет сообщение в чат в рамках транзакции. Строка чата блокируется,
+// пока не закончится транзакция, поэтому номера и время идут в одном порядке.
+// Если чата нет или отправитель в нем не состоит, возвращается sql.ErrNoRows.
+func insertMessage(tx *sql.Tx, nm newMessage) (*Message, []string, error) {
+	chatID, replyToID := nm.ChatID, nm.ReplyToID
+	if nm.Kind == "" {
+		nm.Kind = messageKindUser
+	}
+	var system []byte
+	if nm.System != nil {
+		var err error
+		if system, err = json.Marshal(nm.System); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var seq int64
+	err := tx.QueryRow(`
+		UPDATE chats SET last_seq = last_seq + 1
+		WHERE id = $1
+		RETURNING last_seq
+	`, chatID).Scan(&seq)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Состав чата читается после блокировки, поэтому не меняется до конца транзакции
+	participants, err := chatMembers(tx, chatID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nm.SenderID != "" && !slices.Contains(participants, nm.SenderID) {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	if replyToID != "" {
+		var found bool
+		if _, err := uuid.Parse(replyToID); err == nil {
+			err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM messages WHERE id = $1 AND chat_id = $2)", replyToID, chatID).Scan(&found)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if !found {
+			return nil, nil, errReplyNotFound
+		}
+	}
+
+	// clock_timestamp, а не now(): время должно браться после блокировки чата
+	var m Message
+	err = scanMessage(tx.QueryRow(`
+		INSERT INTO messages (id, chat_id, sender_id, message, seq, created_at, reply_to_id, kind, system, original_message)
+		VALUES ($1, $2, NULLIF($3, '')::uuid, $4, $5, clock_timestamp(), NULLIF($6, '')::uuid, $7, $8, NULLIF($9, ''))
+		RETURNING `+messageColumns,
+		uuid.New().String(), chatID, nm.SenderID, nm.Text, seq, replyToID, nm.Kind, system, nm.OriginalText), &m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.Attachments, err = linkAttachments(tx, m.ID, chatID, nm.SenderID, nm.AttachmentIDs); err != nil {
+		return nil, nil, err
+	}
+	if err := createReceipts(tx, m.ID, nm.SenderID, participants); err != nil {
+		return nil, nil, err
+	}
+	m.Status = receiptSent
+	return &m, participants, nil
+}
+
+func validMessageText(text string) bool {
+	return strings.TrimSpace(text) != "" && utf8.RuneCountInString(text) <= maxMessageLength
+}
+
+// POST /messages — отправить сообщение от имени авторизованного пользователя.
+// Отправитель берется из токена; в чужой чат отправить нельзя, он выглядит несуществующим.
+func sendMessageHandler(c *gin.Context) {
+	var request struct {
+		ChatID  string `json:"chat_id"`
+		Message string `json:"message"`
+		ReplyTo string `json:"reply_to_id"`
+
+		AttachmentIDs []string `json:"attachment_ids"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+
+	// Сообщение с вложениями может быть без текста
+	if !validMessageText(request.Message) && !(len(request.AttachmentIDs) > 0 && request.Message == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Сообщение должно содержать от 1 до %d символов", maxMessageLength)})
+		return
+	}
+	if len(request.AttachmentIDs) > maxAttachmentsPerMessage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("К сообщению можно приложить не больше %d файлов", maxAttachmentsPerMessage)})
+		return
+	}
+	if _, err := uuid.Parse(request.ChatID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return
+	}
+
+	userID := currentUserID(c)
+	moderation, ok := moderateMessage(c, userID, request.Message)
+	if !ok {
+		return
+	}
+	originalText := ""
+	if moderation.Masked {
+		originalText = request.Message
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки сообщения"})
+		return
+	}
+	defer tx.Rollback()
+
+	message, participants, err := insertMessage(tx, newMessage{
+		ChatID:        request.ChatID,
+		SenderID:      userID,
+		Text:          moderation.Text,
+		OriginalText:  originalText,
+		ReplyToID:     request.ReplyTo,
+		AttachmentIDs: request.AttachmentIDs,
+	})
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return
+	} else if err == errReplyNotFound {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Сообщение, на которое дан ответ, не найдено в этом чате"})
+		return
+	} else if err == errAttachmentNotFound {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Вложение не найдено или уже отправлено"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка при добавлении сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки сообщения"})
+		return
+	}
+
+	if err := flagMessage(tx, message.ID, moderation.Flags); err != nil {
+		log.Println("Ошибка при добавлении сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки сообщения"})
+		return
+	}
+	if err := notifyMessageRecipients(tx, message, participants); err != nil {
+		log.Println("Ошибка постановки уведомлений о сообщении:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки сообщения"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Ошибка при добавлении сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки сообщения"})
+		return
+	}
+
+	publishEvent(eventMessageCreated, message.ChatID, message, participants)
+	clearTyping(message.ChatID, userID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Сообщение отправлено", "data": message})
+}
+
+// GET /messages/:chat_id?before=&after=&limit=
+// Курсоры — значения seq. Без курсоров отдаются последние сообщения.
+// Сообщения всегда идут по возрастанию seq, а заголовок X-Has-More говорит,
+// есть ли еще сообщения в направлении загрузки.
+// Историю видят только участники чата, остальным отвечаем 404.
+// Сообщения, которые пользователь удалил у себя, ему не показываются.
+func getMessagesHandler(c *gin.Context) {
+	chatID := c.Param("chat_id")
+	userID := currentUserID(c)
+
+	limit := defaultMessagesPage
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxMessagesPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit должен быть от 1 до %d", maxMessagesPage)})
+			return
+		}
+		limit = n
+	}
+
+	var before, after sql.NullInt64
+	for name, cursor := range map[string]*sql.NullInt64{"before": &before, "after": &after} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный курсор " + name})
+				return
+			}
+			*cursor = sql.NullInt64{Int64: n, Valid: true}
+		}
+	}
+
+	if _, err := uuid.Parse(chatID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return
+	}
+	member, err := isChatMember(db, chatID, userID)
+	if err != nil {
+		log.Printf("Ошибка при проверке чата: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения сообщений"})
+		return
+	}
+	if !member {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return
+	}
+
+	// С after читаем вперед от курсора, иначе — назад от before или от конца чата
+	order := "DESC"
+	if after.Valid && !before.Valid {
+		order = "ASC"
+	}
+	rows, err := db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE chat_id = $1
+		  AND ($2::bigint IS NULL OR seq < $2)
+		  AND ($3::bigint IS NULL OR seq > $3)
+		  AND NOT EXISTS (
+			SELECT 1 FROM message_hidden h
+			WHERE h.message_id = messages.id AND h.user_id = $5
+		  )
+		ORDER BY seq `+order+`
+		LIMIT $4
+	`, chatID, before, after, limit+1, userID)
+	if err != nil {
+		log.Printf("Ошибка при выполнении SQL-запроса: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения сообщений"})
+		return
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := scanMessage(rows, &m); err != nil {
+			log.Printf("Ошибка при сканировании строки: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки сообщений"})
+			return
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Ошибка при чтении сообщений: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения сообщений"})
+		return
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	if order == "DESC" {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	err = attachReceipts(messages)
+	if err == nil {
+		err = attachAttachments(messages)
+	}
+	if err != nil {
+		log.Printf("Ошибка получения статусов и вложений сообщений: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения сообщений"})
+		return
+	}
+
+	c.Header("X-Has-More", strconv.FormatBool(hasMore))
+	c.JSON(http.StatusOK, messages)
+}
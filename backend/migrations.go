@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Миграции схемы вшиты в бинарник: файлы NNNN_имя.up.sql и NNNN_имя.down.sql.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Ключ pg_advisory_lock: пока его держит один экземпляр, другие ждут и
+// потом видят уже примененные миграции
+const migrationLockKey = 0x4d49475241
+
+type migration struct {
+	version  int
+	name     string
+	up, down string
+}
+
+func (m migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.version, m.name)
+}
+
+// loadMigrations читает вшитые миграции, упорядоченные по версии.
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, file := range files {
+		base := path.Base(file)
+		stem, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("миграция %s: ожидается имя вида 0001_name.up.sql", base)
+		}
+		num, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("миграция %s: некорректный номер версии", base)
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		} else if m.name != name {
+			return nil, fmt.Errorf("версия %d встречается у миграций %s и %s", version, m.name, name)
+		}
+		data, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if direction == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("у миграции %s нет файла up или down", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b migration) int { return a.version - b.version })
+	return migrations, nil
+}
+
+// latestMigration — версия последней вшитой миграции.
+func latestMigration(migrations []migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// withMigrationLock выполняет fn на отдельном соединении, держа блокировку миграций.
+// Блокировка сессионная, поэтому снимается и при обрыве соединения.
+func withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("не удалось получить блокировку миграций: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			log.Println("Ошибка снятия блокировки миграций:", err)
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT        NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+type appliedMigration struct {
+	version   int
+	name      string
+	appliedAt time.Time
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) ([]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []appliedMigration
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.version, &a.name, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+// migrate приводит схему к версии, которую выбирает target по уже примененным
+// миграциям: применяет недостающие не новее нее по возрастанию и откатывает
+// примененные новее нее по убыванию. Каждая миграция выполняется в своей
+// транзакции вместе с записью в schema_migrations, так что упавшая миграция
+// не оставляет следов. Возвращает число примененных или откаченных миграций.
+func migrate(ctx context.Context, target func(migrations []migration, applied []appliedMigration) int) (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	known := map[int]migration{}
+	for _, m := range migrations {
+		known[m.version] = m
+	}
+
+	count := 0
+	err = withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		version := target(migrations, applied)
+		isApplied := map[int]bool{}
+		for _, a := range applied {
+			isApplied[a.version] = true
+		}
+
+		for i := len(applied) - 1; i >= 0; i-- {
+			a := applied[i]
+			if a.version <= version {
+				break
+			}
+			m, ok := known[a.version]
+			if !ok {
+				return fmt.Errorf("миграция %04d_%s применена, но ее нет в этой версии бэкенда", a.version, a.name)
+			}
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+			count++
+		}
+
+		for _, m := range migrations {
+			if m.version > version {
+				break
+			}
+			if isApplied[m.version] {
+				continue
+			}
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func runMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	started := time.Now()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script, record, args := m.up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", []any{m.version, m.name}
+	if !up {
+		script, record, args = m.down, "DELETE FROM schema_migrations WHERE version = $1", []any{m.version}
+	}
+	// Без параметров скрипт уходит простым запросом и может состоять из нескольких команд
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("миграция %s: %w", m, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if up {
+		log.Printf("Миграция %s применена за %v", m, time.Since(started).Round(time.Millisecond))
+	} else {
+		log.Printf("Миграция %s откачена за %v", m, time.Since(started).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// migrateUp применяет все недостающие миграции. Миграции новее вшитых, если
+// базу уже обновил более новый бэкенд, остаются как есть.
+func migrateUp(ctx context.Context) (int, error) {
+	return migrate(ctx, func(migrations []migration, applied []appliedMigration) int {
+		version := latestMigration(migrations)
+		if len(applied) > 0 {
+			version = max(version, applied[len(applied)-1].version)
+		}
+		return version
+	})
+}
+
+// migrateDown откатывает steps последних примененных миграций.
+func migrateDown(ctx context.Context, steps int) (int, error) {
+	return migrate(ctx, func(_ []migration, applied []appliedMigration) int {
+		if i := len(applied) - steps - 1; i >= 0 {
+			return applied[i].version
+		}
+		return 0
+	})
+}
+
+// migrateTo приводит схему к версии version, применяя или откатывая миграции.
+func migrateTo(ctx context.Context, version int) (int, error) {
+	return migrate(ctx, func([]migration, []appliedMigration) int { return version })
+}
+
+// markMigrationsApplied записывает миграции до версии target как примененные,
+// не выполняя их. Нужна для базы, схему которой раньше создавали вручную.
+func markMigrationsApplied(ctx context.Context, target int) (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = withMigrationLock(ctx, func(conn *sql.Conn) error {
+		for _, m := range migrations {
+			if m.version > target {
+				break
+			}
+			result, err := conn.ExecContext(ctx, `
+				INSERT INTO schema_migrations (version, name) VALUES ($1, $2)
+				ON CONFLICT (version) DO NOTHING
+			`, m.version, m.name)
+			if err != nil {
+				return err
+			}
+			n, _ := result.RowsAffected()
+			count += n
+		}
+		return nil
+	})
+	return int(count), err
+}
+
+type migrationStatus struct {
+	version   int
+	name      string
+	appliedAt *time.Time
+	missing   bool // применена, но файла в бинарнике нет
+}
+
+// migrationsStatus перечисляет вшитые и примененные миграции по версиям.
+func migrationsStatus(ctx context.Context) ([]migrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	// Статус не ждет блокировку: пока идет миграция, он показывает уже примененные
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var exists bool
+	if err := conn.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	var applied []appliedMigration
+	if exists {
+		if applied, err = appliedMigrations(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	byVersion := map[int]*migrationStatus{}
+	for _, m := range migrations {
+		byVersion[m.version] = &migrationStatus{version: m.version, name: m.name}
+	}
+	for _, a := range applied {
+		s := byVersion[a.version]
+		if s == nil {
+			s = &migrationStatus{version: a.version, name: a.name, missing: true}
+			byVersion[a.version] = s
+		}
+		appliedAt := a.appliedAt
+		s.appliedAt = &appliedAt
+	}
+
+	status := make([]migrationStatus, 0, len(byVersion))
+	for _, s := range byVersion {
+		status = append(status, *s)
+	}
+	slices.SortFunc(status, func(a, b migrationStatus) int { return a.version - b.version })
+	return status, nil
+}
@@ -0,0 +1,63 @@
+-- Исходная схема, которую раньше создавали вручную. IF NOT EXISTS — чтобы
+-- базу, где эти таблицы уже есть, можно было перевести на миграции.
+CREATE TABLE IF NOT EXISTS users (
+    id    UUID PRIMARY KEY,
+    name  TEXT NOT NULL,
+    email TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS apartments (
+    id            SERIAL PRIMARY KEY,
+    title         TEXT           NOT NULL,
+    address       TEXT           NOT NULL,
+    image_link    TEXT           NOT NULL DEFAULT '',
+    description   TEXT           NOT NULL DEFAULT '',
+    square_meters INTEGER        NOT NULL,
+    bedrooms      INTEGER        NOT NULL,
+    price         NUMERIC(12, 2) NOT NULL,
+    favourite     BOOLEAN        NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS cart (
+    id           SERIAL PRIMARY KEY,
+    apartment_id INTEGER NOT NULL REFERENCES apartments (id) ON DELETE CASCADE,
+    user_id      UUID    NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    quantity     INTEGER NOT NULL DEFAULT 1,
+    UNIQUE (apartment_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+    id          SERIAL PRIMARY KEY,
+    user_id     UUID           NOT NULL,
+    total_price NUMERIC(12, 2) NOT NULL,
+    created_at  TIMESTAMPTZ    NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS orders_user_idx ON orders (user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    order_id     INTEGER NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    apartment_id INTEGER NOT NULL REFERENCES apartments (id),
+    quantity     INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_items_order_idx ON order_items (order_id);
+CREATE INDEX IF NOT EXISTS order_items_apartment_idx ON order_items (apartment_id);
+
+CREATE TABLE IF NOT EXISTS chats (
+    id           UUID PRIMARY KEY,
+    participants UUID[]      NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Время сообщения тогда хранилось в секундах Unix, created_at появилось позже
+CREATE TABLE IF NOT EXISTS messages (
+    id          UUID PRIMARY KEY,
+    chat_id     UUID NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+    sender_id   UUID NOT NULL,
+    message     TEXT NOT NULL,
+    "timestamp" BIGINT,
+    created_at  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS messages_chat_idx ON messages (chat_id, created_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS apartments_deleted_at_idx;
+
+ALTER TABLE apartments DROP COLUMN IF EXISTS deleted_at;
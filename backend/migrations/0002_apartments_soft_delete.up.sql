@@ -0,0 +1,3 @@
+ALTER TABLE apartments ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX apartments_deleted_at_idx ON apartments (deleted_at) WHERE deleted_at IS NOT NULL;
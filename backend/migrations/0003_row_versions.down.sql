@@ -0,0 +1,3 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS version;
+
+ALTER TABLE apartments DROP COLUMN IF EXISTS version;
@@ -0,0 +1,3 @@
+ALTER TABLE apartments ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+
+ALTER TABLE orders ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
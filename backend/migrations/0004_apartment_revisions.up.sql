@@ -0,0 +1,14 @@
+CREATE TABLE apartment_revisions (
+    id                 BIGSERIAL PRIMARY KEY,
+    apartment_id       INTEGER     NOT NULL REFERENCES apartments (id) ON DELETE CASCADE,
+    version            BIGINT      NOT NULL,
+    action             TEXT        NOT NULL,
+    changed_by         UUID,
+    changed_at         TIMESTAMPTZ NOT NULL DEFAULT now(),
+    source_revision_id BIGINT REFERENCES apartment_revisions (id) ON DELETE SET NULL,
+    before             JSONB,
+    after              JSONB,
+    changes            JSONB       NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX apartment_revisions_apartment_idx ON apartment_revisions (apartment_id, id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS apartments_external_ref_key;
+
+ALTER TABLE apartments DROP COLUMN IF EXISTS external_ref;
@@ -0,0 +1,3 @@
+ALTER TABLE apartments ADD COLUMN external_ref TEXT;
+
+CREATE UNIQUE INDEX apartments_external_ref_key ON apartments (external_ref);
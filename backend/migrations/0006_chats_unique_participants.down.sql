@@ -0,0 +1 @@
+DROP INDEX IF EXISTS chats_participants_key;
@@ -0,0 +1,23 @@
+-- Пара участников хранится отсортированной, чтобы у нее был ровно один чат
+UPDATE chats
+SET participants = ARRAY(SELECT DISTINCT p FROM unnest(participants) AS p ORDER BY p);
+
+-- Дубликаты, созданные раньше, сливаются в один чат вместе с сообщениями
+WITH ranked AS (
+    SELECT id, first_value(id) OVER (PARTITION BY participants ORDER BY id) AS keep_id
+    FROM chats
+)
+UPDATE messages m
+SET chat_id = r.keep_id
+FROM ranked r
+WHERE m.chat_id = r.id AND r.id <> r.keep_id;
+
+WITH ranked AS (
+    SELECT id, first_value(id) OVER (PARTITION BY participants ORDER BY id) AS keep_id
+    FROM chats
+)
+DELETE FROM chats c
+USING ranked r
+WHERE c.id = r.id AND r.id <> r.keep_id;
+
+CREATE UNIQUE INDEX chats_participants_key ON chats (participants);
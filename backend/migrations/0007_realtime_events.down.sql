@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS realtime_events;
+
+ALTER TABLE orders
+    DROP CONSTRAINT IF EXISTS orders_status_check,
+    DROP COLUMN IF EXISTS status_changed_at,
+    DROP COLUMN IF EXISTS status;
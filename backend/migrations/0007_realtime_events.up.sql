@@ -0,0 +1,17 @@
+ALTER TABLE orders
+    ADD COLUMN status            TEXT        NOT NULL DEFAULT 'pending',
+    ADD COLUMN status_changed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD CONSTRAINT orders_status_check CHECK (status IN ('pending', 'confirmed', 'cancelled', 'completed'));
+
+-- Журнал событий реального времени: по нему клиенты SSE догоняют пропущенное
+CREATE TABLE realtime_events (
+    id         BIGSERIAL PRIMARY KEY,
+    type       TEXT        NOT NULL,
+    chat_id    UUID,
+    payload    JSONB       NOT NULL,
+    recipients UUID[]      NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX realtime_events_recipients_idx ON realtime_events USING GIN (recipients);
+CREATE INDEX realtime_events_created_at_idx ON realtime_events (created_at);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS messages_chat_seq_key;
+
+ALTER TABLE messages ADD COLUMN "timestamp" BIGINT;
+
+UPDATE messages SET "timestamp" = extract(epoch FROM created_at)::bigint;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS seq;
+
+ALTER TABLE chats DROP COLUMN IF EXISTS last_seq;
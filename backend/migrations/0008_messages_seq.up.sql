@@ -0,0 +1,26 @@
+-- Счетчик сообщений чата: каждое новое сообщение получает следующий номер
+ALTER TABLE chats ADD COLUMN last_seq BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE messages ADD COLUMN seq BIGINT;
+
+-- Время сообщения одно — created_at, которое назначает сервер
+UPDATE messages SET created_at = to_timestamp("timestamp") WHERE created_at IS NULL;
+
+UPDATE messages m
+SET seq = numbered.seq
+FROM (
+    SELECT id, row_number() OVER (PARTITION BY chat_id ORDER BY created_at, id) AS seq
+    FROM messages
+) numbered
+WHERE m.id = numbered.id;
+
+UPDATE chats c
+SET last_seq = COALESCE((SELECT max(seq) FROM messages m WHERE m.chat_id = c.id), 0);
+
+ALTER TABLE messages
+    ALTER COLUMN seq SET NOT NULL,
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN created_at SET DEFAULT now(),
+    DROP COLUMN "timestamp";
+
+CREATE UNIQUE INDEX messages_chat_seq_key ON messages (chat_id, seq);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS chats_participants_gin_idx;
+
+DROP TABLE IF EXISTS chat_reads;
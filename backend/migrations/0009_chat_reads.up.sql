@@ -0,0 +1,10 @@
+-- До какого сообщения каждый участник прочитал чат
+CREATE TABLE chat_reads (
+    chat_id       UUID        NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+    user_id       UUID        NOT NULL,
+    last_read_seq BIGINT      NOT NULL DEFAULT 0,
+    updated_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (chat_id, user_id)
+);
+
+CREATE INDEX chats_participants_gin_idx ON chats USING GIN (participants);
@@ -0,0 +1,19 @@
+-- Доставка и прочтение каждого сообщения каждым получателем
+CREATE TABLE message_receipts (
+    message_id   UUID NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    user_id      UUID NOT NULL,
+    delivered_at TIMESTAMPTZ,
+    read_at      TIMESTAMPTZ,
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX message_receipts_user_idx ON message_receipts (user_id) WHERE read_at IS NULL;
+
+-- Старые сообщения считаются прочитанными, если чат был отмечен прочитанным после них
+INSERT INTO message_receipts (message_id, user_id, delivered_at, read_at)
+SELECT m.id, p, r.updated_at, r.updated_at
+FROM messages m
+JOIN chats c ON c.id = m.chat_id
+CROSS JOIN LATERAL unnest(c.participants) AS p
+LEFT JOIN chat_reads r ON r.chat_id = m.chat_id AND r.user_id = p AND r.last_read_seq >= m.seq
+WHERE p <> m.sender_id;
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS message_hidden;
+DROP TABLE IF EXISTS message_edits;
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS deleted_at,
+    DROP COLUMN IF EXISTS edited_at,
+    DROP COLUMN IF EXISTS reply_to_id;
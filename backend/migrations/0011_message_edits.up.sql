@@ -0,0 +1,24 @@
+-- Ответы, правка и удаление сообщений
+ALTER TABLE messages
+    ADD COLUMN reply_to_id UUID REFERENCES messages (id) ON DELETE SET NULL,
+    ADD COLUMN edited_at   TIMESTAMPTZ,
+    ADD COLUMN deleted_at  TIMESTAMPTZ;
+
+-- Прежние версии текста остаются для модерации
+CREATE TABLE message_edits (
+    id          BIGSERIAL PRIMARY KEY,
+    message_id  UUID        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    old_message TEXT        NOT NULL,
+    edited_by   UUID        NOT NULL,
+    edited_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX message_edits_message_idx ON message_edits (message_id, id);
+
+-- Сообщения, которые пользователь удалил только у себя
+CREATE TABLE message_hidden (
+    message_id UUID        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    user_id    UUID        NOT NULL,
+    hidden_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, message_id)
+);
@@ -0,0 +1,18 @@
+-- Файлы, приложенные к сообщениям. Пока сообщение не отправлено, message_id пустой.
+CREATE TABLE message_attachments (
+    id            UUID PRIMARY KEY,
+    chat_id       UUID        NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+    message_id    UUID        REFERENCES messages (id) ON DELETE CASCADE,
+    uploader_id   UUID        NOT NULL,
+    file_name     TEXT        NOT NULL,
+    content_type  TEXT        NOT NULL,
+    size_bytes    BIGINT      NOT NULL CHECK (size_bytes > 0),
+    storage_key   TEXT        NOT NULL,
+    thumbnail_key TEXT,
+    width         INTEGER,
+    height        INTEGER,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX message_attachments_message_idx ON message_attachments (message_id);
+CREATE INDEX message_attachments_unsent_idx ON message_attachments (created_at) WHERE message_id IS NULL;
@@ -0,0 +1,17 @@
+DELETE FROM messages WHERE kind = 'system';
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS system,
+    DROP COLUMN IF EXISTS kind;
+
+-- Не выполнится, если у какой-то пары уже есть несколько чатов: их нужно слить вручную
+DROP INDEX IF EXISTS chats_order_idx;
+DROP INDEX IF EXISTS chats_participants_context_key;
+CREATE UNIQUE INDEX chats_participants_key ON chats (participants);
+
+ALTER TABLE chats
+    DROP COLUMN IF EXISTS order_id,
+    DROP COLUMN IF EXISTS apartment_id;
+
+DROP INDEX IF EXISTS apartments_host_idx;
+ALTER TABLE apartments DROP COLUMN IF EXISTS host_id;
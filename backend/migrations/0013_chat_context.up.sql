@@ -0,0 +1,22 @@
+-- Хозяин квартиры — тот, кому пишут гости
+ALTER TABLE apartments ADD COLUMN host_id UUID;
+
+CREATE INDEX apartments_host_idx ON apartments (host_id) WHERE host_id IS NOT NULL;
+
+-- Чат может быть про конкретную квартиру или бронирование
+ALTER TABLE chats
+    ADD COLUMN apartment_id INTEGER REFERENCES apartments (id) ON DELETE SET NULL,
+    ADD COLUMN order_id     INTEGER REFERENCES orders (id) ON DELETE SET NULL;
+
+-- Одна пара теперь может вести отдельные чаты по разным квартирам и заказам
+DROP INDEX chats_participants_key;
+CREATE UNIQUE INDEX chats_participants_context_key
+    ON chats (participants, (COALESCE(apartment_id, 0)), (COALESCE(order_id, 0)));
+
+CREATE INDEX chats_order_idx ON chats (order_id) WHERE order_id IS NOT NULL;
+
+-- Системные сообщения пишет сам сервис, у них нет отправителя
+ALTER TABLE messages
+    ADD COLUMN kind   TEXT NOT NULL DEFAULT 'user' CHECK (kind IN ('user', 'system')),
+    ADD COLUMN system JSONB,
+    ALTER COLUMN sender_id DROP NOT NULL;
@@ -0,0 +1,21 @@
+-- Групповые чаты в старой схеме не представить, они удаляются вместе с сообщениями
+DELETE FROM chats WHERE kind = 'group';
+
+ALTER TABLE chats DROP CONSTRAINT IF EXISTS chats_direct_key_check;
+DROP INDEX IF EXISTS chats_direct_key;
+
+ALTER TABLE chats ADD COLUMN participants UUID[];
+
+UPDATE chats c
+SET participants = ARRAY(SELECT m.user_id FROM chat_members m WHERE m.chat_id = c.id ORDER BY m.user_id);
+
+CREATE UNIQUE INDEX chats_participants_context_key
+    ON chats (participants, (COALESCE(apartment_id, 0)), (COALESCE(order_id, 0)));
+CREATE INDEX chats_participants_gin_idx ON chats USING GIN (participants);
+
+DROP TABLE IF EXISTS chat_members;
+
+ALTER TABLE chats
+    DROP COLUMN IF EXISTS direct_key,
+    DROP COLUMN IF EXISTS title,
+    DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,34 @@
+-- Групповые чаты и участники в отдельной таблице вместо массива chats.participants
+ALTER TABLE chats
+    ADD COLUMN kind       TEXT NOT NULL DEFAULT 'direct' CHECK (kind IN ('direct', 'group')),
+    ADD COLUMN title      TEXT,
+    ADD COLUMN direct_key TEXT;
+
+CREATE TABLE chat_members (
+    chat_id   UUID        NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+    user_id   UUID        NOT NULL,
+    role      TEXT        NOT NULL DEFAULT 'member' CHECK (role IN ('member', 'admin')),
+    joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (chat_id, user_id)
+);
+
+CREATE INDEX chat_members_user_idx ON chat_members (user_id, chat_id);
+
+INSERT INTO chat_members (chat_id, user_id)
+SELECT c.id, p
+FROM chats c
+CROSS JOIN LATERAL unnest(c.participants) AS p
+ON CONFLICT DO NOTHING;
+
+-- Личный чат пары по-прежнему один на квартиру и заказ: ключ — отсортированная пара
+UPDATE chats SET direct_key = array_to_string(participants, ':');
+
+DROP INDEX chats_participants_context_key;
+DROP INDEX chats_participants_gin_idx;
+ALTER TABLE chats DROP COLUMN participants;
+
+CREATE UNIQUE INDEX chats_direct_key
+    ON chats (direct_key, (COALESCE(apartment_id, 0)), (COALESCE(order_id, 0)))
+    WHERE direct_key IS NOT NULL;
+
+ALTER TABLE chats ADD CONSTRAINT chats_direct_key_check CHECK ((kind = 'direct') = (direct_key IS NOT NULL));
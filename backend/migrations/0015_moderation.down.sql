@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS messaging_blocks;
+DROP TABLE IF EXISTS message_reports;
+ALTER TABLE messages DROP COLUMN IF EXISTS original_message;
@@ -0,0 +1,29 @@
+-- Исходный текст сообщения, если фильтр что-то в нем скрыл
+ALTER TABLE messages ADD COLUMN original_message TEXT;
+
+-- Жалобы пользователей и срабатывания фильтров: очередь модератора
+CREATE TABLE message_reports (
+    id          BIGSERIAL PRIMARY KEY,
+    message_id  UUID        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    reporter_id UUID,
+    source      TEXT        NOT NULL CHECK (source IN ('user', 'filter')),
+    reason      TEXT        NOT NULL,
+    status      TEXT        NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'dismissed', 'actioned')),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_by UUID,
+    resolved_at TIMESTAMPTZ,
+    resolution  TEXT
+);
+
+-- Один пользователь жалуется на сообщение один раз
+CREATE UNIQUE INDEX message_reports_reporter_key ON message_reports (message_id, reporter_id) WHERE reporter_id IS NOT NULL;
+CREATE INDEX message_reports_open_idx ON message_reports (created_at, id) WHERE status = 'open';
+
+-- Пользователи, которым запрещено писать сообщения
+CREATE TABLE messaging_blocks (
+    user_id    UUID PRIMARY KEY,
+    reason     TEXT        NOT NULL,
+    blocked_by UUID,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ
+);
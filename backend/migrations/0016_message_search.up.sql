@@ -0,0 +1,6 @@
+-- Полнотекстовый поиск по сообщениям. Ищется то, что видят участники чата,
+-- поэтому индексируется message, а не original_message.
+ALTER TABLE messages ADD COLUMN search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('russian', message)) STORED;
+
+CREATE INDEX messages_search_idx ON messages USING GIN (search_vector);
@@ -0,0 +1,8 @@
+-- Когда пользователь был в сети и кому это показывать. Онлайн-статус живет в памяти,
+-- сюда время пишется только при выходе из сети.
+CREATE TABLE user_presence (
+    user_id              UUID PRIMARY KEY,
+    last_seen_at         TIMESTAMPTZ,
+    last_seen_visibility TEXT NOT NULL DEFAULT 'everyone'
+        CHECK (last_seen_visibility IN ('everyone', 'contacts', 'nobody'))
+);
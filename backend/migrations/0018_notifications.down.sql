@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS push_devices;
+DROP TABLE IF EXISTS notification_preferences;
+DROP TABLE IF EXISTS notifications;
+
+DROP INDEX IF EXISTS orders_reminders_idx;
+ALTER TABLE orders
+    DROP CONSTRAINT IF EXISTS orders_dates_check,
+    DROP COLUMN IF EXISTS reminder_sent_at,
+    DROP COLUMN IF EXISTS check_out,
+    DROP COLUMN IF EXISTS check_in;
@@ -0,0 +1,42 @@
+-- Даты проживания нужны для напоминаний о заезде. У старых заказов их нет
+ALTER TABLE orders
+    ADD COLUMN check_in         DATE,
+    ADD COLUMN check_out        DATE,
+    ADD COLUMN reminder_sent_at TIMESTAMPTZ,
+    ADD CONSTRAINT orders_dates_check CHECK (check_out IS NULL OR check_in IS NULL OR check_out > check_in);
+
+CREATE INDEX orders_reminders_idx ON orders (check_in) WHERE status = 'confirmed' AND reminder_sent_at IS NULL;
+
+-- Лента уведомлений в приложении
+CREATE TABLE notifications (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    UUID        NOT NULL,
+    kind       TEXT        NOT NULL,
+    title      TEXT        NOT NULL,
+    body       TEXT        NOT NULL,
+    data       JSONB       NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    read_at    TIMESTAMPTZ
+);
+
+CREATE INDEX notifications_user_idx ON notifications (user_id, id DESC);
+CREATE INDEX notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
+
+-- Отличия от настроек по умолчанию: какие уведомления по каким каналам получать
+CREATE TABLE notification_preferences (
+    user_id UUID    NOT NULL,
+    kind    TEXT    NOT NULL,
+    channel TEXT    NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    PRIMARY KEY (user_id, kind, channel)
+);
+
+-- Устройства для push-уведомлений
+CREATE TABLE push_devices (
+    token      TEXT PRIMARY KEY,
+    user_id    UUID        NOT NULL,
+    platform   TEXT        NOT NULL CHECK (platform IN ('android', 'ios', 'web')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX push_devices_user_idx ON push_devices (user_id);
@@ -0,0 +1,61 @@
+-- Исходящие события для партнеров. Пишутся в той же транзакции, что и изменение
+-- заказа или квартиры, и потом раскладываются по подпискам
+CREATE TABLE outbox (
+    id            BIGSERIAL PRIMARY KEY,
+    event_type    TEXT        NOT NULL,
+    payload       JSONB       NOT NULL,
+    -- Хозяева квартир, которых касается событие
+    audience      UUID[]      NOT NULL DEFAULT '{}',
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    dispatched_at TIMESTAMPTZ
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE dispatched_at IS NULL;
+
+CREATE TABLE webhook_endpoints (
+    id         UUID PRIMARY KEY,
+    owner_id   UUID        NOT NULL,
+    url        TEXT        NOT NULL,
+    secret     TEXT        NOT NULL,
+    events     TEXT[]      NOT NULL,
+    -- own — только события по квартирам владельца, all — все (только для администраторов)
+    scope      TEXT        NOT NULL DEFAULT 'own' CHECK (scope IN ('own', 'all')),
+    active     BOOLEAN     NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX webhook_endpoints_owner_idx ON webhook_endpoints (owner_id);
+
+-- Доставка одного события на один адрес. Событие копируется, чтобы его можно было
+-- повторить и после очистки outbox
+CREATE TABLE webhook_deliveries (
+    id               BIGSERIAL PRIMARY KEY,
+    endpoint_id      UUID        NOT NULL REFERENCES webhook_endpoints (id) ON DELETE CASCADE,
+    event_id         BIGINT      NOT NULL,
+    event_type       TEXT        NOT NULL,
+    payload          JSONB       NOT NULL,
+    event_created_at TIMESTAMPTZ NOT NULL,
+    status           TEXT        NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts         INT         NOT NULL DEFAULT 0,
+    next_attempt_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    replay_of        BIGINT REFERENCES webhook_deliveries (id) ON DELETE SET NULL,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at      TIMESTAMPTZ
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_endpoint_idx ON webhook_deliveries (endpoint_id, id DESC);
+
+-- Журнал попыток доставки
+CREATE TABLE webhook_attempts (
+    id            BIGSERIAL PRIMARY KEY,
+    delivery_id   BIGINT      NOT NULL REFERENCES webhook_deliveries (id) ON DELETE CASCADE,
+    attempted_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    status_code   INT,
+    error         TEXT,
+    duration_ms   INT         NOT NULL,
+    response_body TEXT
+);
+
+CREATE INDEX webhook_attempts_delivery_idx ON webhook_attempts (delivery_id, id);
@@ -0,0 +1,21 @@
+-- Фоновые задачи. Ставятся в той же транзакции, что и изменение, которое их порождает
+CREATE TABLE jobs (
+    id           BIGSERIAL PRIMARY KEY,
+    kind         TEXT        NOT NULL,
+    args         JSONB       NOT NULL DEFAULT '{}',
+    -- Пока задача с таким ключом ждет в очереди, вторая такая же не ставится
+    unique_key   TEXT,
+    status       TEXT        NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'done', 'failed')),
+    attempts     INT         NOT NULL DEFAULT 0,
+    max_attempts INT         NOT NULL,
+    run_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- До какого времени задача принадлежит узлу, который ее выполняет
+    locked_until TIMESTAMPTZ,
+    last_error   TEXT,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at  TIMESTAMPTZ
+);
+
+CREATE INDEX jobs_due_idx ON jobs (kind, run_at) WHERE status IN ('queued', 'running');
+CREATE UNIQUE INDEX jobs_unique_key ON jobs (kind, unique_key) WHERE unique_key IS NOT NULL AND status = 'queued';
+CREATE INDEX jobs_finished_idx ON jobs (finished_at) WHERE status IN ('done', 'failed');
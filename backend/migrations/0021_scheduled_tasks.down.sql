@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS scheduled_task_runs;
+DROP TABLE IF EXISTS scheduled_tasks;
+ALTER TABLE cart DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,26 @@
+-- Брошенные корзины очищаются по времени последнего изменения
+ALTER TABLE cart ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- Состояние задач по расписанию. Меняет только ведущий узел планировщика
+CREATE TABLE scheduled_tasks (
+    name             TEXT PRIMARY KEY,
+    next_run_at      TIMESTAMPTZ NOT NULL,
+    -- Ручной запуск из админки: ведущий узел выполнит задачу при следующей проверке
+    run_requested_at TIMESTAMPTZ,
+    requested_by     UUID
+);
+
+CREATE TABLE scheduled_task_runs (
+    id           BIGSERIAL PRIMARY KEY,
+    task         TEXT        NOT NULL,
+    trigger      TEXT        NOT NULL CHECK (trigger IN ('schedule', 'manual')),
+    triggered_by UUID,
+    status       TEXT        NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'succeeded', 'failed')),
+    result       TEXT,
+    error        TEXT,
+    node         UUID        NOT NULL,
+    started_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at  TIMESTAMPTZ
+);
+
+CREATE INDEX scheduled_task_runs_task_idx ON scheduled_task_runs (task, id DESC);
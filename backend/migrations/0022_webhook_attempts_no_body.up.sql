@@ -0,0 +1,7 @@
+-- Тело ответа партнера больше не хранится: через журнал попыток
+-- его можно было бы прочитать с любого адреса, куда ходит сервер
+ALTER TABLE webhook_attempts DROP COLUMN response_body;
+
+-- Прежние тексты ошибок могли содержать подробности о чужих адресах
+UPDATE webhook_attempts SET error = 'не удалось доставить запрос'
+WHERE error IS NOT NULL AND error NOT LIKE 'ответ %';
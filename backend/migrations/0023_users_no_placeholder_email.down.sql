@@ -0,0 +1 @@
+UPDATE users SET email = 'default@example.com' WHERE email = '';
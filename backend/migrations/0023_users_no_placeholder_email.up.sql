@@ -0,0 +1,3 @@
+-- Пользователям, созданным при добавлении в корзину, раньше записывали
+-- адрес-заглушку, и письма уходили на чужой домен. Пустой адрес значит «нет почты»
+UPDATE users SET email = '' WHERE email = 'default@example.com';
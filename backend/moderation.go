@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Что делать с сообщением, в котором сработало правило
+const (
+	moderationReject = "reject" // не отправлять
+	moderationMask   = "mask"   // отправить, скрыв найденное звездочками
+	moderationFlag   = "flag"   // отправить как есть, но показать модератору
+)
+
+// textSpan — найденный фрагмент, границы в байтах.
+type textSpan struct {
+	start, end int
+}
+
+// MessageFilter ищет в тексте сообщения то, что нельзя пропускать без проверки.
+type MessageFilter interface {
+	Name() string
+	Find(text string) []textSpan
+}
+
+type moderationRule struct {
+	filter MessageFilter
+	action string
+}
+
+// moderationResult — итог проверки. Если Rejected не пустой, сообщение не отправляется.
+type moderationResult struct {
+	Text     string
+	Masked   bool
+	Rejected string
+	Flags    []string
+}
+
+type moderationPipeline []moderationRule
+
+// apply прогоняет текст через все правила по порядку. Маскировка одного правила
+// видна следующим, поэтому скрытое не всплывает еще и во флагах.
+func (p moderationPipeline) apply(text string) moderationResult {
+	result := moderationResult{Text: text}
+	for _, rule := range p {
+		spans := rule.filter.Find(result.Text)
+		if len(spans) == 0 {
+			continue
+		}
+		switch rule.action {
+		case moderationReject:
+			result.Rejected = rule.filter.Name()
+			return result
+		case moderationMask:
+			result.Text = maskSpans(result.Text, spans)
+			result.Masked = true
+		case moderationFlag:
+			result.Flags = append(result.Flags, rule.filter.Name())
+		}
+	}
+	return result
+}
+
+// maskSpans заменяет каждый символ найденных фрагментов на звездочку.
+func maskSpans(text string, spans []textSpan) string {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	var b strings.Builder
+	pos := 0
+	for _, s := range spans {
+		if s.end <= pos {
+			continue
+		}
+		if s.start < pos {
+			s.start = pos
+		}
+		b.WriteString(text[pos:s.start])
+		b.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[s.start:s.end])))
+		pos = s.end
+	}
+	b.WriteString(text[pos:])
+	return b.String()
+}
+
+// wordFilter ищет слова из списка без учета регистра и разницы между «е» и «ё».
+// Слово со звездочкой на конце задает начало слова: «груб*» найдет и «грубиян».
+type wordFilter struct {
+	name     string
+	words    map[string]bool
+	prefixes []string
+}
+
+func newWordFilter(name string, list []string) *wordFilter {
+	f := &wordFilter{name: name, words: map[string]bool{}}
+	for _, w := range list {
+		w = normalizeWord(strings.TrimSpace(w))
+		if w == "" || strings.HasPrefix(w, "#") {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(w, "*"); ok {
+			f.prefixes = append(f.prefixes, prefix)
+		} else {
+			f.words[w] = true
+		}
+	}
+	return f
+}
+
+func normalizeWord(w string) string {
+	return strings.ReplaceAll(strings.ToLower(w), "ё", "е")
+}
+
+func (f *wordFilter) Name() string { return f.name }
+
+func (f *wordFilter) Find(text string) []textSpan {
+	var spans []textSpan
+	start := -1
+	check := func(end int) {
+		word := normalizeWord(text[start:end])
+		if f.words[word] {
+			spans = append(spans, textSpan{start, end})
+			return
+		}
+		for _, p := range f.prefixes {
+			if strings.HasPrefix(word, p) {
+				spans = append(spans, textSpan{start, end})
+				return
+			}
+		}
+	}
+	for i, r := range text {
+		if unicode.IsLetter(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			check(i)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		check(len(text))
+	}
+	return spans
+}
+
+// regexpFilter находит фрагменты по регулярным выражениям. accept у шаблона, если задан,
+// отбрасывает совпадения, которые на деле не подходят (например, слишком короткие номера).
+type regexpFilter struct {
+	name     string
+	patterns []filterPattern
+}
+
+type filterPattern struct {
+	re     *regexp.Regexp
+	accept func(match string) bool
+}
+
+func (f *regexpFilter) Name() string { return f.name }
+
+func (f *regexpFilter) Find(text string) []textSpan {
+	var spans []textSpan
+	for _, p := range f.patterns {
+		for _, m := range p.re.FindAllStringIndex(text, -1) {
+			if p.accept == nil || p.accept(text[m[0]:m[1]]) {
+				spans = append(spans, textSpan{m[0], m[1]})
+			}
+		}
+	}
+	return spans
+}
+
+// Корни нецензурных слов по умолчанию. Полный список задается файлом MODERATION_PROFANITY_FILE.
+var defaultProfanity = []string{
+	"хуй*", "хуе*", "хуи*", "пизд*", "ебан*", "ебат*", "еблан*", "выеб*", "заеб*",
+	"бляд*", "блять", "сука", "суки", "мудак*", "мудил*", "гандон*", "пидор*", "пидар*",
+	"fuck*", "shit*", "bitch*", "cunt*", "asshole*",
+}
+
+func newProfanityFilter() MessageFilter {
+	words := defaultProfanity
+	if path := config.Moderation.ProfanityFile; path != "" {
+		if list, err := readWordList(path); err != nil {
+			log.Printf("Не удалось прочитать список слов %s, используется встроенный: %v", path, err)
+		} else {
+			words = list
+		}
+	}
+	return newWordFilter("profanity", words)
+}
+
+func readWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		words = append(words, s.Text())
+	}
+	return words, s.Err()
+}
+
+// Телефоны, почта и мессенджеры: хозяева пытаются увести бронирование мимо платформы
+func newContactFilter() MessageFilter {
+	return &regexpFilter{
+		name: "contacts",
+		patterns: []filterPattern{
+			// Точку как разделитель не берем, иначе под номер попадают даты
+			{re: regexp.MustCompile(`\+?\d[\d\s\-()]{8,}\d`), accept: looksLikePhone},
+			{re: regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)},
+			{re: regexp.MustCompile(`(?i)\b(t\.me|telegram\.me|wa\.me|vk\.com)/\S+`)},
+			{re: regexp.MustCompile(`@[A-Za-z][A-Za-z0-9_]{4,}`)},
+		},
+	}
+}
+
+func looksLikePhone(match string) bool {
+	digits := 0
+	for _, r := range match {
+		if unicode.IsDigit(r) {
+			digits++
+		}
+	}
+	return digits >= 10 && digits <= 15
+}
+
+func newLinkFilter() MessageFilter {
+	return &regexpFilter{
+		name: "links",
+		patterns: []filterPattern{
+			{re: regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)},
+			{re: regexp.MustCompile(`(?i)\b[a-z0-9-]+(\.[a-z0-9-]+)*\.(ru|com|net|org|io|me|info|su|biz|online|site)\b(/\S*)?`)},
+		},
+	}
+}
+
+// Фильтры по именам, которые можно указывать в MODERATION_RULES
+var messageFilters = map[string]func() MessageFilter{
+	"profanity": newProfanityFilter,
+	"contacts":  newContactFilter,
+	"links":     newLinkFilter,
+}
+
+// Правила по умолчанию: брань не пропускаем, контакты скрываем, ссылки показываем модератору
+const defaultModerationRules = "profanity=reject,contacts=mask,links=flag"
+
+// parseModerationRules разбирает строку вида "profanity=reject,contacts=mask,links=flag".
+// Правила применяются в указанном порядке; action off выключает правило.
+func parseModerationRules(spec string) (moderationPipeline, error) {
+	var pipeline moderationPipeline
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, action, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("правило %q должно иметь вид имя=действие", part)
+		}
+		newFilter, ok := messageFilters[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("неизвестный фильтр %q", name)
+		}
+		switch action = strings.TrimSpace(action); action {
+		case moderationReject, moderationMask, moderationFlag:
+			pipeline = append(pipeline, moderationRule{filter: newFilter(), action: action})
+		case "off":
+		default:
+			return nil, fmt.Errorf("неизвестное действие %q для фильтра %s", action, name)
+		}
+	}
+	return pipeline, nil
+}
+
+var messageModeration moderationPipeline
+
+func initModeration() {
+	spec := config.Moderation.Rules
+	if spec == "" {
+		spec = defaultModerationRules
+	}
+	pipeline, err := parseModerationRules(spec)
+	if err != nil {
+		log.Fatalf("Некорректная настройка MODERATION_RULES: %v", err)
+	}
+	messageModeration = pipeline
+}
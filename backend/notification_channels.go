@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Каналы доставки уведомлений
+const (
+	channelInApp = "in_app"
+	channelEmail = "email"
+	channelPush  = "push"
+)
+
+// renderedNotification — уведомление, готовое к отправке по любому каналу.
+type renderedNotification struct {
+	UserID string
+	Kind   string
+	Title  string
+	Body   string
+	Data   map[string]any
+}
+
+// NotificationChannel доставляет уведомление пользователю одним способом.
+// Если у пользователя нет адреса для канала (почты, устройств), это не ошибка.
+type NotificationChannel interface {
+	Name() string
+	Deliver(n renderedNotification) error
+}
+
+// inAppChannel сохраняет уведомление в ленту и сразу показывает его в приложении.
+type inAppChannel struct{}
+
+func (inAppChannel) Name() string { return channelInApp }
+
+func (inAppChannel) Deliver(n renderedNotification) error {
+	data, err := marshalNotificationData(n.Data)
+	if err != nil {
+		return err
+	}
+	var saved Notification
+	err = scanNotification(db.QueryRow(`
+		INSERT INTO notifications (user_id, kind, title, body, data)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+notificationColumns,
+		n.UserID, n.Kind, n.Title, n.Body, data), &saved)
+	if err != nil {
+		return err
+	}
+	publishEvent(eventNotificationCreated, "", saved, []string{n.UserID})
+	return nil
+}
+
+// Mailer отправляет одно письмо.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// smtpMailer работает с любым SMTP-сервером, в том числе с локальным тестовым
+// вроде MailHog: STARTTLS используется, только если сервер его предлагает,
+// а без SMTP_USERNAME письма уходят без авторизации.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPMailer(addr, from, username, password string) *smtpMailer {
+	m := &smtpMailer{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// smtpMailerFromConfig создает почтовый клиент по настройкам smtp.
+// Без адреса сервера почта выключена и возвращается nil.
+func smtpMailerFromConfig() *smtpMailer {
+	s := config.SMTP
+	if s.Addr == "" {
+		return nil
+	}
+	return newSMTPMailer(s.Addr, s.From, s.Username, string(s.Password))
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(body)
+	msg.WriteString("\r\n")
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, msg.Bytes())
+}
+
+// deliverableEmail отсеивает пустые адреса и адреса в зарезервированном домене
+// example.com: на них письма не доходят, а раньше туда попадали заглушки.
+func deliverableEmail(email string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	return email != "" && !strings.HasSuffix(email, "@example.com")
+}
+
+type emailChannel struct {
+	mailer Mailer
+}
+
+func (emailChannel) Name() string { return channelEmail }
+
+func (ch emailChannel) Deliver(n renderedNotification) error {
+	var email sql.NullString
+	err := db.QueryRow("SELECT email FROM users WHERE id = $1", n.UserID).Scan(&email)
+	if err == sql.ErrNoRows || (err == nil && !deliverableEmail(email.String)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	body := n.Body + "\n\n--\nНастроить уведомления можно в приложении."
+	return ch.mailer.Send(email.String, n.Title, body)
+}
+
+// PushMessage — то, что увидит пользователь на экране устройства.
+type PushMessage struct {
+	Title string         `json:"title"`
+	Body  string         `json:"body"`
+	Data  map[string]any `json:"data,omitempty"`
+}
+
+type PushDevice struct {
+	Token    string `json:"token"`
+	Platform string `json:"platform"`
+}
+
+// Токен больше не действует (приложение удалено): устройство надо забыть
+var errPushTokenInvalid = errors.New("push-токен недействителен")
+
+// PushSender отправляет push-уведомление на одно устройство через провайдера (FCM, APNs).
+type PushSender interface {
+	Send(device PushDevice, msg PushMessage) error
+}
+
+// logPushSender только пишет уведомления в журнал. Включается явно
+// (PUSH_PROVIDER=log), пока не подключен настоящий провайдер.
+type logPushSender struct{}
+
+func (logPushSender) Send(device PushDevice, msg PushMessage) error {
+	log.Printf("Push на %s-устройство: %s", device.Platform, msg.Title)
+	return nil
+}
+
+// pushSenderFromConfig выбирает провайдера по настройке push.provider.
+// Без провайдера push выключен и возвращается nil.
+func pushSenderFromConfig() PushSender {
+	switch config.Push.Provider {
+	case "log":
+		return logPushSender{}
+	}
+	return nil
+}
+
+type pushChannel struct {
+	sender PushSender
+}
+
+func (pushChannel) Name() string { return channelPush }
+
+func (ch pushChannel) Deliver(n renderedNotification) error {
+	rows, err := db.Query("SELECT token, platform FROM push_devices WHERE user_id = $1", n.UserID)
+	if err != nil {
+		return err
+	}
+	var devices []PushDevice
+	for rows.Next() {
+		var d PushDevice
+		if err := rows.Scan(&d.Token, &d.Platform); err != nil {
+			rows.Close()
+			return err
+		}
+		devices = append(devices, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	invalid, err := sendPush(ch.sender, devices, PushMessage{Title: n.Title, Body: n.Body, Data: n.Data})
+	for _, token := range invalid {
+		if _, err := db.Exec("DELETE FROM push_devices WHERE token = $1", token); err != nil {
+			log.Println("Ошибка удаления устройства:", err)
+		}
+	}
+	return err
+}
+
+// sendPush отправляет уведомление на все устройства и возвращает токены, которые
+// провайдер отверг как недействительные. Ошибка — последняя из остальных.
+func sendPush(sender PushSender, devices []PushDevice, msg PushMessage) (invalid []string, failed error) {
+	for _, d := range devices {
+		err := sender.Send(d, msg)
+		if errors.Is(err, errPushTokenInvalid) {
+			invalid = append(invalid, d.Token)
+		} else if err != nil {
+			failed = err
+		}
+	}
+	return invalid, failed
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer — SMTP-сервер в памяти процесса: принимает одно письмо
+// и запоминает все, что прислал клиент.
+type fakeSMTPServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	auth     string // расшифрованное значение AUTH PLAIN
+	mailFrom string
+	rcptTo   []string
+	data     string
+	done     chan struct{}
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{ln: ln, done: make(chan struct{})}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTPServer) serve() {
+	defer close(s.done)
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP fake")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250-localhost")
+			reply("250-8BITMIME")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(cmd, "AUTH PLAIN"):
+			decoded, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(line[len("AUTH PLAIN"):]))
+			s.mu.Lock()
+			s.auth = string(decoded)
+			s.mu.Unlock()
+			reply("235 2.7.0 Authentication successful")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.mu.Lock()
+			s.mailFrom = line[len("MAIL FROM:"):]
+			s.mu.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.mu.Lock()
+			s.rcptTo = append(s.rcptTo, line[len("RCPT TO:"):])
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.data = data.String()
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	server := startFakeSMTP(t)
+	mailer := newSMTPMailer(server.ln.Addr().String(), "noreply@example.com", "robot", "s3cret")
+
+	if err := mailer.Send("guest@example.com", "Заказ №42 подтвержден", "Статус вашего заказа изменился."); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-server.done
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.auth != "\x00robot\x00s3cret" {
+		t.Errorf("AUTH PLAIN = %q, нужен логин robot с паролем s3cret", server.auth)
+	}
+	if !strings.Contains(server.mailFrom, "<noreply@example.com>") {
+		t.Errorf("MAIL FROM = %q", server.mailFrom)
+	}
+	if len(server.rcptTo) != 1 || !strings.Contains(server.rcptTo[0], "<guest@example.com>") {
+		t.Errorf("RCPT TO = %q", server.rcptTo)
+	}
+	for _, want := range []string{
+		"From: noreply@example.com\r\n",
+		"To: guest@example.com\r\n",
+		"Subject: =?utf-8?q?",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"\r\n\r\nСтатус вашего заказа изменился.\r\n",
+	} {
+		if !strings.Contains(server.data, want) {
+			t.Errorf("в письме нет %q:\n%s", want, server.data)
+		}
+	}
+}
+
+func TestSMTPMailerWithoutAuth(t *testing.T) {
+	server := startFakeSMTP(t)
+	mailer := newSMTPMailer(server.ln.Addr().String(), "noreply@example.com", "", "")
+
+	if err := mailer.Send("guest@example.com", "Проверка", "Текст"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-server.done
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.auth != "" {
+		t.Errorf("без SMTP_USERNAME авторизации быть не должно, получено %q", server.auth)
+	}
+}
+
+// RecordedPush — push-уведомление, которое получил recordingPushSender.
+type RecordedPush struct {
+	Device PushDevice
+	Msg    PushMessage
+}
+
+// recordingPushSender ничего не отправляет, а запоминает уведомления.
+// Токены из invalid он отвергает как недействительные.
+type recordingPushSender struct {
+	mu      sync.Mutex
+	invalid map[string]bool
+	sent    []RecordedPush
+}
+
+func (s *recordingPushSender) Send(device PushDevice, msg PushMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.invalid[device.Token] {
+		return errPushTokenInvalid
+	}
+	s.sent = append(s.sent, RecordedPush{Device: device, Msg: msg})
+	return nil
+}
+
+func TestSendPush(t *testing.T) {
+	sender := &recordingPushSender{invalid: map[string]bool{"stale": true}}
+	devices := []PushDevice{
+		{Token: "phone", Platform: "ios"},
+		{Token: "stale", Platform: "android"},
+		{Token: "tablet", Platform: "android"},
+	}
+	msg := PushMessage{Title: "Новое сообщение", Body: "Привет", Data: map[string]any{"chat_id": "c1"}}
+
+	invalid, err := sendPush(sender, devices, msg)
+	if err != nil {
+		t.Fatalf("sendPush: %v", err)
+	}
+	if len(invalid) != 1 || invalid[0] != "stale" {
+		t.Errorf("недействительные токены = %v, нужен [stale]", invalid)
+	}
+	if len(sender.sent) != 2 || sender.sent[0].Device.Token != "phone" || sender.sent[1].Device.Token != "tablet" {
+		t.Fatalf("отправлено %+v", sender.sent)
+	}
+	if got := sender.sent[0].Msg; got.Title != msg.Title || got.Body != msg.Body || got.Data["chat_id"] != "c1" {
+		t.Errorf("уведомление = %+v", got)
+	}
+}
+
+type failingPushSender struct{ err error }
+
+func (s failingPushSender) Send(PushDevice, PushMessage) error { return s.err }
+
+func TestSendPushReportsProviderError(t *testing.T) {
+	providerErr := errors.New("провайдер недоступен")
+	invalid, err := sendPush(failingPushSender{err: providerErr}, []PushDevice{{Token: "phone"}}, PushMessage{})
+	if !errors.Is(err, providerErr) {
+		t.Errorf("ошибка = %v, нужна %v", err, providerErr)
+	}
+	if len(invalid) != 0 {
+		t.Errorf("при сбое провайдера токены не должны считаться недействительными: %v", invalid)
+	}
+}
+
+// Пустые адреса и заглушки в домене example.com письма не получают.
+func TestDeliverableEmail(t *testing.T) {
+	for email, want := range map[string]bool{
+		"guest@mail.ru":        true,
+		"":                     false,
+		"default@example.com":  false,
+		" Default@Example.COM": false,
+	} {
+		if got := deliverableEmail(email); got != want {
+			t.Errorf("deliverableEmail(%q) = %v, ожидалось %v", email, got, want)
+		}
+	}
+}
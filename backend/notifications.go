@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Виды уведомлений
+const (
+	notifyNewMessage      = "message.new"
+	notifyOrderStatus     = "order.status"
+	notifyBookingReminder = "booking.reminder"
+)
+
+const eventNotificationCreated = "notification.created"
+
+// notificationKind — шаблоны уведомления и каналы, включенные по умолчанию.
+// Шаблоны получают данные уведомления; их же клиент получает в поле data.
+type notificationKind struct {
+	title    *template.Template
+	body     *template.Template
+	defaults map[string]bool
+	// Пользователю, который сейчас в приложении, хватает ленты и событий чата
+	skipWhenOnline bool
+}
+
+func notificationTemplate(name, text string) *template.Template {
+	return template.Must(template.New(name).Option("missingkey=error").Parse(text))
+}
+
+var notificationKinds = map[string]notificationKind{
+	notifyNewMessage: {
+		title:          notificationTemplate("message.title", "Новое сообщение от {{.sender_name}}"),
+		body:           notificationTemplate("message.body", "{{.text}}"),
+		defaults:       map[string]bool{channelInApp: false, channelEmail: false, channelPush: true},
+		skipWhenOnline: true,
+	},
+	notifyOrderStatus: {
+		title:    notificationTemplate("order.title", "Заказ №{{.order_id}} {{.status_title}}"),
+		body:     notificationTemplate("order.body", "Статус вашего заказа №{{.order_id}} изменился: {{.status_title}}."),
+		defaults: map[string]bool{channelInApp: true, channelEmail: true, channelPush: true},
+	},
+	notifyBookingReminder: {
+		title:    notificationTemplate("reminder.title", "Скоро заезд"),
+		body:     notificationTemplate("reminder.body", "Напоминаем: заезд по заказу №{{.order_id}} — {{.check_in}}."),
+		defaults: map[string]bool{channelInApp: true, channelEmail: true, channelPush: true},
+	},
+}
+
+var notificationChannelNames = []string{channelInApp, channelEmail, channelPush}
+
+// Notification — запись ленты уведомлений.
+type Notification struct {
+	ID        int64           `json:"id"`
+	Kind      string          `json:"kind"`
+	Title     string          `json:"title"`
+	Body      string          `json:"body"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+	ReadAt    *time.Time      `json:"read_at"`
+}
+
+const notificationColumns = "id, kind, title, body, data, created_at, read_at"
+
+func scanNotification(row rowScanner, n *Notification) error {
+	var data []byte
+	var readAt sql.NullTime
+	if err := row.Scan(&n.ID, &n.Kind, &n.Title, &n.Body, &data, &n.CreatedAt, &readAt); err != nil {
+		return err
+	}
+	n.Data = json.RawMessage(data)
+	n.ReadAt = nil
+	if readAt.Valid {
+		n.ReadAt = &readAt.Time
+	}
+	return nil
+}
+
+func marshalNotificationData(data map[string]any) ([]byte, error) {
+	if data == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(data)
+}
+
+var notificationChannels []NotificationChannel
+
+// initNotifications настраивает каналы. Почта включается, если задан адрес SMTP-сервера,
+// push — если выбран провайдер.
+func initNotifications() {
+	notificationChannels = []NotificationChannel{inAppChannel{}}
+	if sender := pushSenderFromConfig(); sender != nil {
+		notificationChannels = append(notificationChannels, pushChannel{sender: sender})
+	} else {
+		log.Println("ВНИМАНИЕ: push-провайдер не задан (PUSH_PROVIDER), push-уведомления не отправляются")
+	}
+	if mailer := smtpMailerFromConfig(); mailer != nil {
+		notificationChannels = append(notificationChannels, emailChannel{mailer: mailer})
+	} else {
+		log.Println("SMTP-сервер не задан, уведомления по почте не отправляются")
+	}
+}
+
+type deliverNotificationArgs struct {
+	UserID  string         `json:"user_id"`
+	Kind    string         `json:"kind"`
+	Channel string         `json:"channel"`
+	Data    map[string]any `json:"data"`
+}
+
+// Каждый канал доставляется отдельной задачей: если не ответила почта,
+// повторно отправляется только письмо
+var deliverNotificationJob = defineJob("notification.deliver", jobOptions{Timeout: 30 * time.Second, Concurrency: 8}, deliverNotification)
+
+// notify ставит уведомление в очередь фоновых задач. Если q — транзакция,
+// уведомление уйдет, только когда она будет зафиксирована.
+func notify(q querier, userID, kind string, data map[string]any) error {
+	for _, channel := range notificationChannelNames {
+		args := deliverNotificationArgs{UserID: userID, Kind: kind, Channel: channel, Data: data}
+		if err := deliverNotificationJob.enqueue(q, args, enqueueOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deliverNotification(ctx context.Context, req deliverNotificationArgs) error {
+	kind, ok := notificationKinds[req.Kind]
+	if !ok {
+		return permanentJobError(fmt.Errorf("неизвестный вид уведомления %s", req.Kind))
+	}
+	i := slices.IndexFunc(notificationChannels, func(ch NotificationChannel) bool { return ch.Name() == req.Channel })
+	if i < 0 {
+		return nil // канал выключен на этом сервере
+	}
+	enabled, err := notificationPreferences(req.UserID, req.Kind)
+	if err != nil {
+		return err
+	}
+	if !enabled[req.Channel] || (kind.skipWhenOnline && presence.isOnline(req.UserID)) {
+		return nil
+	}
+
+	n := renderedNotification{UserID: req.UserID, Kind: req.Kind, Data: req.Data}
+	var title, body strings.Builder
+	if err := kind.title.Execute(&title, req.Data); err != nil {
+		return permanentJobError(fmt.Errorf("шаблон уведомления %s: %w", req.Kind, err))
+	}
+	if err := kind.body.Execute(&body, req.Data); err != nil {
+		return permanentJobError(fmt.Errorf("шаблон уведомления %s: %w", req.Kind, err))
+	}
+	n.Title, n.Body = title.String(), body.String()
+
+	return notificationChannels[i].Deliver(n)
+}
+
+// notificationPreferences возвращает, по каким каналам пользователь получает уведомления
+// этого вида: настройки по умолчанию с учетом его изменений.
+func notificationPreferences(userID, kind string) (map[string]bool, error) {
+	enabled := map[string]bool{}
+	for channel, on := range notificationKinds[kind].defaults {
+		enabled[channel] = on
+	}
+
+	rows, err := db.Query("SELECT channel, enabled FROM notification_preferences WHERE user_id = $1 AND kind = $2", userID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel string
+		var on bool
+		if err := rows.Scan(&channel, &on); err != nil {
+			return nil, err
+		}
+		enabled[channel] = on
+	}
+	return enabled, rows.Err()
+}
+
+// Сколько текста сообщения попадает в уведомление
+const notificationTextLimit = 200
+
+type messageNotificationArgs struct {
+	ChatID     string   `json:"chat_id"`
+	MessageID  string   `json:"message_id"`
+	SenderID   string   `json:"sender_id"`
+	Text       string   `json:"text"`
+	Recipients []string `json:"recipients"`
+}
+
+// Имя отправителя ищется уже в фоне, чтобы не задерживать отправку сообщения
+var messageNotificationJob = defineJob("message.notify", jobOptions{}, func(ctx context.Context, args messageNotificationArgs) error {
+	names, err := userNames([]string{args.SenderID})
+	if err != nil {
+		return err
+	}
+	senderName := names[args.SenderID]
+	if senderName == "" {
+		senderName = "собеседника"
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range args.Recipients {
+		err := notify(tx, p, notifyNewMessage, map[string]any{
+			"chat_id":     args.ChatID,
+			"message_id":  args.MessageID,
+			"sender_id":   args.SenderID,
+			"sender_name": senderName,
+			"text":        args.Text,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+})
+
+// notifyMessageRecipients ставит в очередь уведомления участникам чата,
+// кроме отправителя, о новом сообщении. Вызывается в транзакции сообщения.
+func notifyMessageRecipients(q querier, m *Message, participants []string) error {
+	text := m.Message
+	if utf8.RuneCountInString(text) > notificationTextLimit {
+		text = string([]rune(text)[:notificationTextLimit]) + "…"
+	}
+	if text == "" && len(m.Attachments) > 0 {
+		text = "Вложение"
+	}
+	recipients := slices.DeleteFunc(slices.Clone(participants), func(p string) bool { return p == m.SenderID })
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	return messageNotificationJob.enqueue(q, messageNotificationArgs{
+		ChatID:     m.ChatID,
+		MessageID:  m.ID,
+		SenderID:   m.SenderID,
+		Text:       text,
+		Recipients: recipients,
+	}, enqueueOptions{})
+}
+
+// sendBookingReminders напоминает о заезде, когда до него остается не больше суток.
+// Заказы отмечаются в той же транзакции, в которой ставятся уведомления,
+// поэтому напоминание уходит один раз. Возвращает число напоминаний.
+func sendBookingReminders(ctx context.Context) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE orders SET reminder_sent_at = now()
+		WHERE status = 'confirmed' AND reminder_sent_at IS NULL
+		  AND check_in BETWEEN current_date AND current_date + 1
+		RETURNING id, user_id, check_in
+	`)
+	if err != nil {
+		return 0, err
+	}
+	type reminder struct {
+		orderID int
+		userID  string
+		checkIn time.Time
+	}
+	var reminders []reminder
+	for rows.Next() {
+		var r reminder
+		if err := rows.Scan(&r.orderID, &r.userID, &r.checkIn); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		reminders = append(reminders, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, r := range reminders {
+		err := notify(tx, r.userID, notifyBookingReminder, map[string]any{
+			"order_id": r.orderID,
+			"check_in": r.checkIn.Format("02.01.2006"),
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(reminders), nil
+}
+
+// GET /notifications?unread=true&limit=&offset= — лента уведомлений, новые первыми.
+// X-Unread-Count — сколько всего непрочитанных.
+func getNotificationsHandler(c *gin.Context) {
+	userID := currentUserID(c)
+	limit, offset, ok := pageParams(c, 50, 200)
+	if !ok {
+		return
+	}
+	unreadOnly := c.Query("unread") == "true"
+
+	rows, err := db.Query(`
+		SELECT `+notificationColumns+`
+		FROM notifications
+		WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4
+	`, userID, unreadOnly, limit+1, offset)
+	if err != nil {
+		log.Println("Ошибка получения уведомлений:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения уведомлений"})
+		return
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := scanNotification(rows, &n); err != nil {
+			log.Println("Ошибка обработки уведомления:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения уведомлений"})
+			return
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка получения уведомлений:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения уведомлений"})
+		return
+	}
+
+	var unread int
+	if err := db.QueryRow("SELECT count(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL", userID).Scan(&unread); err != nil {
+		log.Println("Ошибка подсчета уведомлений:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения уведомлений"})
+		return
+	}
+
+	hasMore := len(notifications) > limit
+	if hasMore {
+		notifications = notifications[:limit]
+	}
+	c.Header("X-Has-More", strconv.FormatBool(hasMore))
+	c.Header("X-Unread-Count", strconv.Itoa(unread))
+	c.JSON(http.StatusOK, notifications)
+}
+
+// POST /notifications/:id/read
+func markNotificationReadHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Уведомление не найдено"})
+		return
+	}
+
+	var n Notification
+	err = scanNotification(db.QueryRow(`
+		UPDATE notifications SET read_at = COALESCE(read_at, now())
+		WHERE id = $1 AND user_id = $2
+		RETURNING `+notificationColumns, id, currentUserID(c)), &n)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Уведомление не найдено"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка обновления уведомления:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления уведомления"})
+		return
+	}
+
+	c.JSON(http.StatusOK, n)
+}
+
+// POST /notifications/read_all
+func markAllNotificationsReadHandler(c *gin.Context) {
+	res, err := db.Exec("UPDATE notifications SET read_at = now() WHERE user_id = $1 AND read_at IS NULL", currentUserID(c))
+	if err != nil {
+		log.Println("Ошибка обновления уведомлений:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления уведомлений"})
+		return
+	}
+	marked, _ := res.RowsAffected()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Уведомления прочитаны", "marked": marked})
+}
+
+type NotificationPreference struct {
+	Kind    string `json:"kind"`
+	Channel string `json:"channel"`
+	Enabled bool   `json:"enabled"`
+}
+
+// GET /notifications/preferences — все виды уведомлений по всем каналам.
+func getNotificationPreferencesHandler(c *gin.Context) {
+	userID := currentUserID(c)
+
+	prefs := []NotificationPreference{}
+	for _, kind := range []string{notifyNewMessage, notifyOrderStatus, notifyBookingReminder} {
+		enabled, err := notificationPreferences(userID, kind)
+		if err != nil {
+			log.Println("Ошибка получения настроек уведомлений:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения настроек уведомлений"})
+			return
+		}
+		for _, channel := range notificationChannelNames {
+			prefs = append(prefs, NotificationPreference{Kind: kind, Channel: channel, Enabled: enabled[channel]})
+		}
+	}
+
+	c.JSON(http.StatusOK, prefs)
+}
+
+// PUT /notifications/preferences — включить или выключить виды уведомлений по каналам.
+// Не упомянутые в запросе настройки не меняются.
+func updateNotificationPreferencesHandler(c *gin.Context) {
+	userID := currentUserID(c)
+
+	var request []NotificationPreference
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	var kinds, channels []string
+	var enabled []bool
+	for _, p := range request {
+		if _, ok := notificationKinds[p.Kind]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Неизвестный вид уведомлений %q", p.Kind)})
+			return
+		}
+		if _, ok := notificationKinds[p.Kind].defaults[p.Channel]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Неизвестный канал %q", p.Channel)})
+			return
+		}
+		kinds = append(kinds, p.Kind)
+		channels = append(channels, p.Channel)
+		enabled = append(enabled, p.Enabled)
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO notification_preferences (user_id, kind, channel, enabled)
+		SELECT $1, k, ch, e FROM unnest($2::text[], $3::text[], $4::boolean[]) AS p(k, ch, e)
+		ON CONFLICT (user_id, kind, channel) DO UPDATE SET enabled = EXCLUDED.enabled
+	`, userID, pq.Array(kinds), pq.Array(channels), pq.Array(enabled))
+	if err != nil {
+		log.Println("Ошибка сохранения настроек уведомлений:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения настроек уведомлений"})
+		return
+	}
+
+	getNotificationPreferencesHandler(c)
+}
+
+// POST /notifications/devices — зарегистрировать устройство для push-уведомлений.
+// Токен, который раньше принадлежал другому пользователю, переходит к текущему.
+func registerPushDeviceHandler(c *gin.Context) {
+	var request PushDevice
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	request.Token = strings.TrimSpace(request.Token)
+	if request.Token == "" || len(request.Token) > 4096 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный token"})
+		return
+	}
+	switch request.Platform {
+	case "android", "ios", "web":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "platform должен быть android, ios или web"})
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO push_devices (token, user_id, platform) VALUES ($1, $2, $3)
+		ON CONFLICT (token) DO UPDATE
+		SET user_id = EXCLUDED.user_id, platform = EXCLUDED.platform, created_at = now()
+	`, request.Token, currentUserID(c), request.Platform)
+	if err != nil {
+		log.Println("Ошибка регистрации устройства:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка регистрации устройства"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, request)
+}
+
+// DELETE /notifications/devices/:token — например, при выходе из аккаунта.
+func unregisterPushDeviceHandler(c *gin.Context) {
+	_, err := db.Exec("DELETE FROM push_devices WHERE token = $1 AND user_id = $2", c.Param("token"), currentUserID(c))
+	if err != nil {
+		log.Println("Ошибка удаления устройства:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка удаления устройства"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
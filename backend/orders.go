@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Статусы заказа
+const (
+	orderPending   = "pending"
+	orderConfirmed = "confirmed"
+	orderCancelled = "cancelled"
+	orderCompleted = "completed"
+)
+
+// Из какого статуса в какой можно перевести заказ
+var orderTransitions = map[string][]string{
+	orderPending:   {orderConfirmed, orderCancelled},
+	orderConfirmed: {orderCompleted, orderCancelled},
+}
+
+// Как статус называется в системных сообщениях чата
+var orderStatusTitles = map[string]string{
+	orderPending:   "ожидает подтверждения",
+	orderConfirmed: "подтвержден",
+	orderCancelled: "отменен",
+	orderCompleted: "завершен",
+}
+
+func orderTransitionAllowed(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// PUT /orders/status/:id — смена статуса заказа.
+// Гость может только отменить свой заказ, администратор — выполнить любой допустимый переход.
+// Поддерживает If-Match с версией заказа.
+func updateOrderStatusHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	var request struct {
+		Status string `json:"status"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	switch request.Status {
+	case orderPending, orderConfirmed, orderCancelled, orderCompleted:
+	default:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Неизвестный статус заказа"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления заказа"})
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID, status string
+	var version int64
+	err = tx.QueryRow("SELECT user_id, status, version FROM orders WHERE id = $1 FOR UPDATE", id).Scan(&ownerID, &status, &version)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Заказ не найден"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения заказа:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления заказа"})
+		return
+	}
+
+	isAdmin := c.GetString("role") == "admin"
+	if !isAdmin && ownerID != currentUserID(c) {
+		// Чужие заказы не раскрываем
+		c.JSON(http.StatusNotFound, gin.H{"error": "Заказ не найден"})
+		return
+	}
+	if !isAdmin && request.Status != orderCancelled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Гость может только отменить заказ"})
+		return
+	}
+
+	if versions := ifMatchVersions(c); versions != nil {
+		matched := false
+		for _, v := range versions {
+			if v == version {
+				matched = true
+			}
+		}
+		if !matched {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Заказ был изменен другим пользователем"})
+			return
+		}
+	}
+
+	if !orderTransitionAllowed(status, request.Status) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Недопустимая смена статуса", "from": status, "to": request.Status})
+		return
+	}
+
+	change, err := changeOrderStatus(tx, id, ownerID, status, request.Status)
+	if err != nil {
+		log.Println("Ошибка обновления заказа:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления заказа"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления заказа"})
+		return
+	}
+	change.publish()
+	version = change.version
+
+	c.Header("ETag", versionETag(int(version)))
+	c.JSON(http.StatusOK, gin.H{"message": "Статус заказа обновлен", "status": request.Status, "version": version})
+}
+
+// orderStatusChange — смена статуса, о которой после фиксации транзакции
+// надо сообщить гостю и хозяевам в реальном времени.
+type orderStatusChange struct {
+	orderID, ownerID string
+	from, to         string
+	version          int64
+	changedAt        time.Time
+	posted           []postedMessage
+}
+
+// changeOrderStatus переводит заказ, заблокированный в tx, в статус to и в той же
+// транзакции записывает событие для партнеров, уведомление гостю и системные
+// сообщения в чаты. Допустимость перехода проверяет вызывающий.
+func changeOrderStatus(tx *sql.Tx, orderID, ownerID, from, to string) (*orderStatusChange, error) {
+	ch := &orderStatusChange{orderID: orderID, ownerID: ownerID, from: from, to: to}
+	err := tx.QueryRow(`
+		UPDATE orders
+		SET status = $1, status_changed_at = now(), version = version + 1
+		WHERE id = $2
+		RETURNING version, status_changed_at
+	`, to, orderID).Scan(&ch.version, &ch.changedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if eventType, ok := orderStatusEvents[to]; ok {
+		if err := enqueueOrderEvent(tx, eventType, orderID); err != nil {
+			return nil, fmt.Errorf("событие заказа: %w", err)
+		}
+	}
+	err = notify(tx, ownerID, notifyOrderStatus, map[string]any{
+		"order_id":     orderID,
+		"status":       to,
+		"status_title": orderStatusTitles[to],
+	})
+	if err != nil {
+		return nil, fmt.Errorf("уведомление: %w", err)
+	}
+	if ch.posted, err = postOrderStatusMessages(tx, orderID, ownerID, from, to); err != nil {
+		return nil, fmt.Errorf("системное сообщение: %w", err)
+	}
+	return ch, nil
+}
+
+// publish рассылает события смены статуса. Вызывается после фиксации транзакции.
+func (ch *orderStatusChange) publish() {
+	publishEvent(eventOrderStatusChanged, "", gin.H{
+		"order_id":   ch.orderID,
+		"from":       ch.from,
+		"status":     ch.to,
+		"version":    ch.version,
+		"changed_at": ch.changedAt,
+	}, []string{ch.ownerID})
+	for _, p := range ch.posted {
+		publishEvent(eventMessageCreated, p.message.ChatID, p.message, p.participants)
+	}
+}
+
+// completeFinishedOrders завершает подтвержденные заказы, у которых прошла дата выезда.
+// Каждый заказ меняется в своей транзакции, как при ручной смене статуса.
+func completeFinishedOrders(ctx context.Context) (int, error) {
+	completed := 0
+	for ctx.Err() == nil {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return completed, err
+		}
+		var orderID, ownerID string
+		err = tx.QueryRow(`
+			SELECT id, user_id FROM orders
+			WHERE status = 'confirmed' AND check_out < current_date
+			ORDER BY check_out, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		`).Scan(&orderID, &ownerID)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			return completed, nil
+		}
+		var change *orderStatusChange
+		if err == nil {
+			change, err = changeOrderStatus(tx, orderID, ownerID, orderConfirmed, orderCompleted)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return completed, fmt.Errorf("заказ %s: %w", orderID, err)
+		}
+		change.publish()
+		completed++
+	}
+	return completed, ctx.Err()
+}
+
+type postedMessage struct {
+	message      *Message
+	participants []string
+}
+
+// postOrderStatusMessages пишет о смене статуса в чаты гостя с хозяевами квартир из заказа.
+// Чат по заказу создается, если гость еще не писал хозяину.
+func postOrderStatusMessages(tx *sql.Tx, orderID, ownerID, from, to string) ([]postedMessage, error) {
+	order, err := strconv.Atoi(orderID)
+	if err != nil {
+		return nil, nil
+	}
+	if _, err := uuid.Parse(ownerID); err != nil {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(`
+		SELECT DISTINCT a.id, a.host_id
+		FROM order_items oi
+		JOIN apartments a ON a.id = oi.apartment_id
+		WHERE oi.order_id = $1 AND a.host_id IS NOT NULL
+		ORDER BY a.id
+	`, order)
+	if err != nil {
+		return nil, err
+	}
+	type host struct {
+		apartmentID int64
+		hostID      string
+	}
+	var hosts []host
+	for rows.Next() {
+		var h host
+		if err := rows.Scan(&h.apartmentID, &h.hostID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var posted []postedMessage
+	for _, h := range hosts {
+		participants, err := canonicalParticipants([]string{ownerID, h.hostID})
+		if err != nil {
+			// Хозяин забронировал собственную квартиру
+			continue
+		}
+		chatID, _, err := openChat(tx, participants,
+			sql.NullInt64{Int64: h.apartmentID, Valid: true}, sql.NullInt64{Int64: int64(order), Valid: true})
+		if err != nil {
+			return nil, err
+		}
+		message, recipients, err := insertMessage(tx, newMessage{
+			ChatID: chatID,
+			Kind:   messageKindSystem,
+			Text:   fmt.Sprintf("Заказ №%d %s", order, orderStatusTitles[to]),
+			System: gin.H{
+				"type":     eventOrderStatusChanged,
+				"order_id": order,
+				"from":     from,
+				"status":   to,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		posted = append(posted, postedMessage{message: message, participants: recipients})
+	}
+	return posted, nil
+}
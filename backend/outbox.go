@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// События для партнеров
+const (
+	outboxOrderCreated   = "order.created"
+	outboxOrderConfirmed = "order.confirmed"
+	outboxOrderCancelled = "order.cancelled"
+	outboxOrderCompleted = "order.completed"
+
+	outboxApartmentCreated = "apartment.created"
+	outboxApartmentUpdated = "apartment.updated"
+	outboxApartmentDeleted = "apartment.deleted"
+)
+
+var outboxEventTypes = []string{
+	outboxOrderCreated, outboxOrderConfirmed, outboxOrderCancelled, outboxOrderCompleted,
+	outboxApartmentCreated, outboxApartmentUpdated, outboxApartmentDeleted,
+}
+
+// Событие о заказе по его новому статусу
+var orderStatusEvents = map[string]string{
+	orderConfirmed: outboxOrderConfirmed,
+	orderCancelled: outboxOrderCancelled,
+	orderCompleted: outboxOrderCompleted,
+}
+
+// enqueueOutbox записывает событие в outbox. Вызывается в транзакции изменения,
+// поэтому событие появляется тогда и только тогда, когда изменение сохранено.
+// audience — хозяева квартир, которых касается событие.
+func enqueueOutbox(tx *sql.Tx, eventType string, payload any, audience []string) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if audience == nil {
+		audience = []string{}
+	}
+	_, err = tx.Exec("INSERT INTO outbox (event_type, payload, audience) VALUES ($1, $2, $3)",
+		eventType, data, pq.Array(audience))
+	if err != nil {
+		return err
+	}
+	return scheduleOutboxDispatch(tx)
+}
+
+// enqueueOrderEvent записывает событие о заказе вместе с его составом.
+// Получатели — хозяева квартир из заказа.
+func enqueueOrderEvent(tx *sql.Tx, eventType string, orderID any) error {
+	_, err := tx.Exec(`
+		INSERT INTO outbox (event_type, payload, audience)
+		SELECT $1,
+		       jsonb_build_object(
+		           'order_id', o.id,
+		           'user_id', o.user_id,
+		           'status', o.status,
+		           'total_price', o.total_price,
+		           'check_in', o.check_in,
+		           'check_out', o.check_out,
+		           'version', o.version,
+		           'items', COALESCE((
+		               SELECT jsonb_agg(jsonb_build_object('apartment_id', oi.apartment_id, 'quantity', oi.quantity) ORDER BY oi.apartment_id)
+		               FROM order_items oi WHERE oi.order_id = o.id
+		           ), '[]')
+		       ),
+		       ARRAY(
+		           SELECT DISTINCT a.host_id
+		           FROM order_items oi JOIN apartments a ON a.id = oi.apartment_id
+		           WHERE oi.order_id = o.id AND a.host_id IS NOT NULL
+		       )
+		FROM orders o
+		WHERE o.id = $2
+	`, eventType, orderID)
+	if err != nil {
+		return err
+	}
+	return scheduleOutboxDispatch(tx)
+}
+
+// apartmentEventType — событие для партнеров по действию из истории квартиры.
+func apartmentEventType(action string) string {
+	switch action {
+	case revisionCreate:
+		return outboxApartmentCreated
+	case revisionDelete:
+		return outboxApartmentDeleted
+	}
+	return outboxApartmentUpdated
+}
+
+// Сколько хранятся разосланные события
+const outboxRetention = 7 * 24 * time.Hour
+
+const outboxBatch = 100
+
+// Одной задачи рассылки в очереди достаточно: она разбирает все накопившиеся события
+var dispatchOutboxJob = defineJob("outbox.dispatch", jobOptions{Concurrency: 1}, func(ctx context.Context, _ struct{}) error {
+	for {
+		n, err := dispatchOutbox(ctx, outboxBatch)
+		if err != nil || n < outboxBatch {
+			return err
+		}
+	}
+})
+
+func scheduleOutboxDispatch(tx *sql.Tx) error {
+	return dispatchOutboxJob.enqueue(tx, struct{}{}, enqueueOptions{UniqueKey: "outbox"})
+}
+
+// dispatchOutbox раскладывает неразосланные события по подпискам партнеров,
+// ставит доставки в очередь и возвращает, сколько событий обработано.
+// Несколько экземпляров бэкенда берут разные события благодаря SKIP LOCKED.
+func dispatchOutbox(ctx context.Context, batch int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var n int
+	var deliveries []int64
+	err = tx.QueryRow(`
+		WITH batch AS (
+			SELECT id, event_type, payload, audience, created_at
+			FROM outbox
+			WHERE dispatched_at IS NULL
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), deliveries AS (
+			INSERT INTO webhook_deliveries (endpoint_id, event_id, event_type, payload, event_created_at)
+			SELECT e.id, b.id, b.event_type, b.payload, b.created_at
+			FROM batch b
+			JOIN webhook_endpoints e
+			  ON e.active AND b.event_type = ANY(e.events)
+			 AND (e.scope = 'all' OR e.owner_id = ANY(b.audience))
+			ORDER BY b.id
+			RETURNING id
+		), dispatched AS (
+			UPDATE outbox SET dispatched_at = now()
+			FROM batch WHERE outbox.id = batch.id
+		)
+		SELECT (SELECT count(*) FROM batch), ARRAY(SELECT id FROM deliveries ORDER BY id)
+	`, batch).Scan(&n, pq.Array(&deliveries))
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range deliveries {
+		if err := scheduleWebhookDelivery(tx, id, time.Time{}); err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
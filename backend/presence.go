@@ -0,0 +1,461 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// Клиент повторяет typing каждые несколько секунд, пока пользователь печатает.
+	// Если повтора не было, остальные участники получают typing.stopped
+	typingTTL = 6 * time.Second
+	// Как часто узел напоминает остальным, кто к нему подключен, и сколько
+	// живет такое напоминание. Онлайн-статус с упавшего узла пропадает через presenceTTL
+	presenceSyncInterval = 20 * time.Second
+	presenceTTL          = 3 * presenceSyncInterval
+	// В NOTIFY помещается около 8000 байт, поэтому список подключенных режется на части
+	presenceSyncBatch = 150
+)
+
+// Кому видно время последнего входа
+const (
+	lastSeenEveryone = "everyone"
+	lastSeenContacts = "contacts" // только тем, с кем есть общий чат
+	lastSeenNobody   = "nobody"
+)
+
+type typingKey struct {
+	chatID, userID string
+}
+
+type typingState struct {
+	expires    time.Time
+	recipients []string
+}
+
+// presenceTracker хранит в памяти, кто сейчас в сети и кто печатает.
+// Подключения этого узла считаются точно, о других узлах он знает по событиям
+// presence.changed и presence.sync. В базу пишется только время выхода из сети.
+type presenceTracker struct {
+	mu    sync.Mutex
+	local map[string]int // число подключений пользователя к этому узлу
+	// До какого времени пользователь в сети по данным каждого из других узлов:
+	// выход с одного узла не значит, что пользователь не подключен к другому
+	remote map[string]map[string]time.Time
+	typing map[typingKey]typingState
+}
+
+var presence = &presenceTracker{
+	local:  map[string]int{},
+	remote: map[string]map[string]time.Time{},
+	typing: map[typingKey]typingState{},
+}
+
+type presencePayload struct {
+	UserID   string    `json:"user_id"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type presenceSyncPayload struct {
+	Users []string `json:"users"`
+}
+
+func (p *presenceTracker) onlineLocked(userID string, now time.Time) bool {
+	if p.local[userID] > 0 {
+		return true
+	}
+	for _, expires := range p.remote[userID] {
+		if expires.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *presenceTracker) isOnline(userID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.onlineLocked(userID, time.Now())
+}
+
+// connect учитывает новое подключение. Другие узлы узнают о первом подключении
+// пользователя к этому узлу сразу, не дожидаясь presence.sync, а контакты —
+// только если пользователь не был подключен ни к одному узлу.
+func (p *presenceTracker) connect(userID string) {
+	now := time.Now()
+	p.mu.Lock()
+	first := p.local[userID] == 0
+	wasOnline := p.onlineLocked(userID, now)
+	p.local[userID]++
+	p.mu.Unlock()
+
+	if first {
+		go announcePresence(userID, true, now, !wasOnline)
+	}
+}
+
+// disconnect учитывает закрытое подключение. Когда к узлу не осталось подключений
+// пользователя, другие узлы об этом узнают, а контакты — только если пользователь
+// не подключен и к другим узлам.
+func (p *presenceTracker) disconnect(userID string) {
+	now := time.Now()
+	p.mu.Lock()
+	last := false
+	if p.local[userID]--; p.local[userID] <= 0 {
+		delete(p.local, userID)
+		last = true
+	}
+	nowOffline := last && !p.onlineLocked(userID, now)
+	p.mu.Unlock()
+
+	if last {
+		go func() {
+			if nowOffline {
+				if err := saveLastSeen(userID, now); err != nil {
+					log.Println("Ошибка сохранения времени последнего входа:", err)
+				}
+			}
+			announcePresence(userID, false, now, nowOffline)
+		}()
+	}
+}
+
+// observe применяет онлайн-статусы, пришедшие с других узлов.
+func (p *presenceTracker) observe(e Event) {
+	expires := time.Now().Add(presenceTTL)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch e.Type {
+	case eventPresenceChanged:
+		var payload presencePayload
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			log.Println("Некорректное событие присутствия:", err)
+			return
+		}
+		if payload.Online {
+			p.setRemoteLocked(payload.UserID, e.Origin, expires)
+		} else if nodes := p.remote[payload.UserID]; nodes != nil {
+			delete(nodes, e.Origin)
+			if len(nodes) == 0 {
+				delete(p.remote, payload.UserID)
+			}
+		}
+	case eventPresenceSync:
+		var payload presenceSyncPayload
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			log.Println("Некорректное событие присутствия:", err)
+			return
+		}
+		for _, userID := range payload.Users {
+			p.setRemoteLocked(userID, e.Origin, expires)
+		}
+	}
+}
+
+func (p *presenceTracker) setRemoteLocked(userID, node string, expires time.Time) {
+	if p.remote[userID] == nil {
+		p.remote[userID] = map[string]time.Time{}
+	}
+	p.remote[userID][node] = expires
+}
+
+// startTyping продлевает признак набора и возвращает true, если пользователь только начал печатать.
+func (p *presenceTracker) startTyping(chatID, userID string, recipients []string) bool {
+	key := typingKey{chatID, userID}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.typing[key]
+	p.typing[key] = typingState{expires: now.Add(typingTTL), recipients: recipients}
+	return !ok || !state.expires.After(now)
+}
+
+// stopTyping снимает признак набора и возвращает получателей, если он был.
+func (p *presenceTracker) stopTyping(chatID, userID string) ([]string, bool) {
+	key := typingKey{chatID, userID}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.typing[key]
+	delete(p.typing, key)
+	return state.recipients, ok
+}
+
+// sweep убирает истекшие признаки набора и онлайн-статусы других узлов.
+// Если узел упал, его пользователи молча пропадают из сети: объявить об этом некому.
+func (p *presenceTracker) sweep(now time.Time) map[typingKey][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	expired := map[typingKey][]string{}
+	for key, state := range p.typing {
+		if !state.expires.After(now) {
+			expired[key] = state.recipients
+			delete(p.typing, key)
+		}
+	}
+	for userID, nodes := range p.remote {
+		for node, expires := range nodes {
+			if !expires.After(now) {
+				delete(nodes, node)
+			}
+		}
+		if len(nodes) == 0 {
+			delete(p.remote, userID)
+		}
+	}
+	return expired
+}
+
+func (p *presenceTracker) localUsers() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	users := make([]string, 0, len(p.local))
+	for userID := range p.local {
+		users = append(users, userID)
+	}
+	return users
+}
+
+func saveLastSeen(userID string, at time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO user_presence (user_id, last_seen_at) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET last_seen_at = GREATEST(user_presence.last_seen_at, EXCLUDED.last_seen_at)
+	`, userID, at)
+	return err
+}
+
+// announcePresence сообщает другим узлам о входе или выходе пользователя, а если
+// notify — еще и тем, с кем у него есть общие чаты, если он не скрыл время
+// последнего входа. Другие узлы узнают о статусе в любом случае, даже если получателей нет.
+func announcePresence(userID string, online bool, at time.Time, notify bool) {
+	if hub == nil {
+		return
+	}
+
+	var recipients []string
+	if notify {
+		recipients = presenceRecipients(userID)
+	}
+	e, err := newEvent(eventPresenceChanged, "", presencePayload{UserID: userID, Online: online, LastSeen: at}, recipients)
+	if err != nil {
+		log.Println("Ошибка подготовки события:", err)
+		return
+	}
+	hub.Publish(e)
+}
+
+// presenceRecipients — контакты пользователя, которым виден его онлайн-статус.
+func presenceRecipients(userID string) []string {
+	var recipients []string
+	rows, err := db.Query(`
+		SELECT DISTINCT other.user_id
+		FROM chat_members me
+		JOIN chat_members other ON other.chat_id = me.chat_id AND other.user_id <> me.user_id
+		WHERE me.user_id = $1
+		  AND NOT EXISTS (SELECT 1 FROM user_presence p WHERE p.user_id = $1 AND p.last_seen_visibility = 'nobody')
+	`, userID)
+	if err == nil {
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil {
+				break
+			}
+			recipients = append(recipients, id)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	if err != nil {
+		log.Println("Ошибка получения контактов пользователя:", err)
+		return nil
+	}
+	return recipients
+}
+
+// runPresence снимает истекшие признаки набора и напоминает другим узлам,
+// кто подключен к этому.
+func runPresence() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastSync := time.Now()
+
+	for now := range ticker.C {
+		for key, recipients := range presence.sweep(now) {
+			publishEphemeral(eventTypingStopped, key.chatID, typingPayload(key.chatID, key.userID), recipients)
+		}
+
+		if hub == nil || now.Sub(lastSync) < presenceSyncInterval {
+			continue
+		}
+		lastSync = now
+		for batch := range slices.Chunk(presence.localUsers(), presenceSyncBatch) {
+			e, err := newEvent(eventPresenceSync, "", presenceSyncPayload{Users: batch}, nil)
+			if err != nil {
+				log.Println("Ошибка подготовки события:", err)
+				continue
+			}
+			hub.Publish(e)
+		}
+	}
+}
+
+func typingPayload(chatID, userID string) gin.H {
+	return gin.H{"chat_id": chatID, "user_id": userID}
+}
+
+// clearTyping снимает признак набора, например когда пользователь отправил сообщение.
+func clearTyping(chatID, userID string) {
+	if recipients, ok := presence.stopTyping(chatID, userID); ok {
+		publishEphemeral(eventTypingStopped, chatID, typingPayload(chatID, userID), recipients)
+	}
+}
+
+// POST /chats/:chat_id/typing — пользователь печатает ({"typing": true}) или перестал.
+// Пока пользователь печатает, клиент повторяет запрос чаще, чем раз в typingTTL.
+// Остальные участники получают typing.started один раз и typing.stopped в конце.
+func typingHandler(c *gin.Context) {
+	chatID := c.Param("chat_id")
+	userID := currentUserID(c)
+
+	var request struct {
+		Typing *bool `json:"typing"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	typing := request.Typing == nil || *request.Typing
+	if _, err := uuid.Parse(chatID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return
+	}
+
+	members, err := chatMembers(db, chatID)
+	if err != nil {
+		log.Println("Ошибка получения участников чата:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки статуса"})
+		return
+	}
+	if !slices.Contains(members, userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+		return
+	}
+	recipients := slices.DeleteFunc(members, func(id string) bool { return id == userID })
+
+	if !typing {
+		// Признак мог быть заведен на другом узле, поэтому о конце набора сообщаем всегда
+		presence.stopTyping(chatID, userID)
+		publishEphemeral(eventTypingStopped, chatID, typingPayload(chatID, userID), recipients)
+	} else if presence.startTyping(chatID, userID, recipients) {
+		publishEphemeral(eventTypingStarted, chatID, typingPayload(chatID, userID), recipients)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// UserPresence — онлайн-статус пользователя. Если пользователь скрыл время
+// последнего входа от спрашивающего, Visible = false, а остальные поля пустые.
+type UserPresence struct {
+	UserID   string     `json:"user_id"`
+	Visible  bool       `json:"visible"`
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"last_seen"`
+}
+
+// GET /users/:user_id/presence
+func getUserPresenceHandler(c *gin.Context) {
+	viewerID := currentUserID(c)
+	userID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+		return
+	}
+
+	visibility := lastSeenEveryone
+	var lastSeen sql.NullTime
+	var shareChat bool
+	err = db.QueryRow(`
+		SELECT COALESCE(p.last_seen_visibility, 'everyone'), p.last_seen_at,
+		       EXISTS (SELECT 1 FROM chat_members me
+		               JOIN chat_members other ON other.chat_id = me.chat_id
+		               WHERE me.user_id = $2 AND other.user_id = $1)
+		FROM (SELECT 1) AS one
+		LEFT JOIN user_presence p ON p.user_id = $1
+	`, userID.String(), viewerID).Scan(&visibility, &lastSeen, &shareChat)
+	if err != nil {
+		log.Println("Ошибка получения статуса пользователя:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения статуса пользователя"})
+		return
+	}
+
+	result := UserPresence{UserID: userID.String()}
+	switch {
+	case userID.String() == viewerID, visibility == lastSeenEveryone:
+		result.Visible = true
+	case visibility == lastSeenContacts:
+		result.Visible = shareChat
+	}
+	if result.Visible {
+		result.Online = presence.isOnline(result.UserID)
+		if lastSeen.Valid {
+			result.LastSeen = &lastSeen.Time
+		}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// GET /users/me/privacy
+func getPrivacyHandler(c *gin.Context) {
+	var visibility string
+	err := db.QueryRow("SELECT last_seen_visibility FROM user_presence WHERE user_id = $1", currentUserID(c)).Scan(&visibility)
+	if err == sql.ErrNoRows {
+		visibility = lastSeenEveryone
+	} else if err != nil {
+		log.Println("Ошибка получения настроек приватности:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения настроек приватности"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"last_seen": visibility})
+}
+
+// PUT /users/me/privacy — кому показывать онлайн-статус и время последнего входа.
+func updatePrivacyHandler(c *gin.Context) {
+	var request struct {
+		LastSeen string `json:"last_seen"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	if !slices.Contains([]string{lastSeenEveryone, lastSeenContacts, lastSeenNobody}, request.LastSeen) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "last_seen должен быть everyone, contacts или nobody"})
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO user_presence (user_id, last_seen_visibility) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET last_seen_visibility = EXCLUDED.last_seen_visibility
+	`, currentUserID(c), request.LastSeen)
+	if err != nil {
+		log.Println("Ошибка сохранения настроек приватности:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сохранения настроек приватности"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"last_seen": request.LastSeen})
+}
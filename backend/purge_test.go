@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// openTestDB подключается к базе из TEST_DATABASE_URL и накатывает миграции.
+// Без нее тесты, которым нужна база, пропускаются.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL не задан")
+	}
+	conn, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = conn
+	t.Cleanup(func() {
+		db = saved
+		conn.Close()
+	})
+	if _, err := migrateUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// У пары уже есть общий чат без квартиры и чат про удаленную квартиру.
+// Стирание квартиры обнулило бы apartment_id второго чата и столкнулось
+// с первым на уникальном индексе, поэтому такая квартира остается,
+// а остальные удаленные квартиры стираются как обычно.
+func TestPurgeKeepsApartmentsWithChats(t *testing.T) {
+	openTestDB(t)
+
+	insertDeleted := func() int {
+		var id int
+		err := db.QueryRow(`
+			INSERT INTO apartments (title, address, square_meters, bedrooms, price, deleted_at)
+			VALUES ('Тест', 'Тест', 30, 1, 1000, now() - interval '2 hours')
+			RETURNING id
+		`).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	withChat, withoutChat := insertDeleted(), insertDeleted()
+	t.Cleanup(func() { db.Exec("DELETE FROM apartments WHERE id = ANY($1)", pq.Array([]int{withChat, withoutChat})) })
+
+	directKey := uuid.NewString() + ":" + uuid.NewString()
+	for _, apartmentID := range []any{nil, withChat} {
+		if _, err := db.Exec(
+			"INSERT INTO chats (id, kind, direct_key, apartment_id) VALUES ($1, 'direct', $2, $3)",
+			uuid.NewString(), directKey, apartmentID,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM chats WHERE direct_key = $1", directKey) })
+
+	if _, err := purgeDeletedApartments(time.Hour); err != nil {
+		t.Fatalf("purgeDeletedApartments: %v", err)
+	}
+
+	var remaining []int
+	rows, err := db.Query("SELECT id FROM apartments WHERE id IN ($1, $2)", withChat, withoutChat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		remaining = append(remaining, id)
+	}
+	if len(remaining) != 1 || remaining[0] != withChat {
+		t.Fatalf("остались квартиры %v, ожидалась только %d", remaining, withChat)
+	}
+}
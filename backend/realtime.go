@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Типы событий, которые получают клиенты в реальном времени
+const (
+	eventMessageCreated   = "message.created"
+	eventMessageEdited    = "message.edited"
+	eventMessageDeleted   = "message.deleted"
+	eventMessageDelivered = "message.delivered"
+	eventMessageRead      = "message.read"
+
+	eventOrderStatusChanged = "order.status_changed"
+
+	// Эфемерные события: не пишутся в журнал и не повторяются после переподключения
+	eventTypingStarted   = "typing.started"
+	eventTypingStopped   = "typing.stopped"
+	eventPresenceChanged = "presence.changed"
+	// Служебное событие между узлами: кто подключен к узлу-отправителю. Клиентам не уходит
+	eventPresenceSync = "presence.sync"
+)
+
+// Event доставляется всем подключенным клиентам пользователей из Recipients.
+// ID — номер события в журнале realtime_events, по нему клиенты SSE догоняют пропущенное.
+// Origin — узел, который опубликовал событие.
+type Event struct {
+	ID         int64           `json:"id,omitempty"`
+	Type       string          `json:"type"`
+	ChatID     string          `json:"chat_id,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+	Recipients []string        `json:"recipients,omitempty"`
+	Origin     string          `json:"origin,omitempty"`
+}
+
+func newEvent(eventType, chatID string, payload any, recipients []string) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Type: eventType, ChatID: chatID, Payload: data, Recipients: recipients}, nil
+}
+
+// Broker разносит события между экземплярами бэкенда.
+// Publish отправляет событие всем узлам, включая текущий,
+// а deliver вызывается на каждом узле для каждого полученного события.
+type Broker interface {
+	Publish(e Event) error
+	Start(deliver func(Event)) error
+}
+
+// memoryBroker подходит, когда бэкенд запущен в одном экземпляре.
+type memoryBroker struct {
+	deliver func(Event)
+}
+
+func (b *memoryBroker) Start(deliver func(Event)) error {
+	b.deliver = deliver
+	return nil
+}
+
+func (b *memoryBroker) Publish(e Event) error {
+	b.deliver(e)
+	return nil
+}
+
+// Канал PostgreSQL, через который узлы обмениваются событиями
+const realtimeChannel = "realtime_events"
+
+// PostgreSQL не принимает в NOTIFY больше 8000 байт. Событие крупнее
+// уходит ссылкой на журнал, и узлы читают его из realtime_events
+const notifyPayloadLimit = 7900
+
+// notifyEnvelope — то, что передается через NOTIFY: само событие или,
+// если оно не помещается, только номер в журнале.
+type notifyEnvelope struct {
+	Event
+	Ref int64 `json:"ref,omitempty"`
+}
+
+// pgBroker рассылает события через LISTEN/NOTIFY, чтобы несколько
+// экземпляров бэкенда видели сообщения друг друга.
+// Текущий узел получает свои же уведомления обратно и доставляет их как чужие.
+type pgBroker struct {
+	connStr string
+}
+
+func (b *pgBroker) Start(deliver func(Event)) error {
+	listener := pq.NewListener(b.connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Ошибка соединения LISTEN:", err)
+		}
+	})
+	if err := listener.Listen(realtimeChannel); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case n := <-listener.Notify:
+				// nil приходит после переподключения: часть событий могла потеряться
+				if n == nil {
+					log.Println("Соединение LISTEN восстановлено")
+					continue
+				}
+				var env notifyEnvelope
+				if err := json.Unmarshal([]byte(n.Extra), &env); err != nil {
+					log.Println("Некорректное событие из NOTIFY:", err)
+					continue
+				}
+				e := env.Event
+				if env.Ref != 0 {
+					var err error
+					if e, err = loadLoggedEvent(env.Ref); err != nil {
+						log.Printf("Ошибка чтения события %d из журнала: %v", env.Ref, err)
+						continue
+					}
+					e.Origin = env.Origin
+				}
+				deliver(e)
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *pgBroker) Publish(e Event) error {
+	data, err := json.Marshal(notifyEnvelope{Event: e})
+	if err != nil {
+		return err
+	}
+	if len(data) > notifyPayloadLimit {
+		if e.ID == 0 {
+			return fmt.Errorf("событие занимает %d байт и не помещается в NOTIFY", len(data))
+		}
+		if data, err = json.Marshal(notifyEnvelope{Event: Event{Origin: e.Origin}, Ref: e.ID}); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("SELECT pg_notify($1, $2)", realtimeChannel, string(data))
+	return err
+}
+
+// Hub хранит подключения пользователей этого узла и раздает им события.
+type Hub struct {
+	broker Broker
+	node   string
+
+	mu      sync.RWMutex
+	clients map[string]map[*realtimeClient]struct{}
+}
+
+// realtimeClient — одно подключение. Если клиент не успевает читать
+// и буфер переполнился, подключение закрывается, а не тормозит остальных.
+type realtimeClient struct {
+	userID string
+	send   chan Event
+	once   sync.Once
+}
+
+func (c *realtimeClient) close() {
+	c.once.Do(func() { close(c.send) })
+}
+
+var hub *Hub
+
+func newHub(broker Broker) (*Hub, error) {
+	h := &Hub{broker: broker, node: uuid.New().String(), clients: map[string]map[*realtimeClient]struct{}{}}
+	if err := broker.Start(h.deliver); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// subscribe и unsubscribe сообщают об онлайн-статусе уже после снятия блокировки:
+// presence сам публикует события, а они проходят через deliver.
+func (h *Hub) subscribe(userID string) *realtimeClient {
+	client := &realtimeClient{userID: userID, send: make(chan Event, 64)}
+
+	h.mu.Lock()
+	if h.clients[userID] == nil {
+		h.clients[userID] = map[*realtimeClient]struct{}{}
+	}
+	h.clients[userID][client] = struct{}{}
+	h.mu.Unlock()
+
+	presence.connect(userID)
+	return client
+}
+
+// unsubscribe можно вызвать для одного подключения несколько раз.
+func (h *Hub) unsubscribe(client *realtimeClient) {
+	h.mu.Lock()
+	_, subscribed := h.clients[client.userID][client]
+	if subscribed {
+		delete(h.clients[client.userID], client)
+		if len(h.clients[client.userID]) == 0 {
+			delete(h.clients, client.userID)
+		}
+	}
+	h.mu.Unlock()
+	client.close()
+
+	if subscribed {
+		presence.disconnect(client.userID)
+	}
+}
+
+// Publish отправляет событие через брокер. Ошибка только пишется в лог:
+// данные уже сохранены, а клиенты догонят их при следующей загрузке.
+func (h *Hub) Publish(e Event) {
+	if e.Origin == "" {
+		e.Origin = h.node
+	}
+	if err := h.broker.Publish(e); err != nil {
+		log.Printf("Ошибка публикации события %s: %v", e.Type, err)
+	}
+}
+
+func (h *Hub) deliver(e Event) {
+	// Онлайн-статусы с других узлов. Свои события узел уже учел при публикации
+	if e.Origin != h.node && (e.Type == eventPresenceChanged || e.Type == eventPresenceSync) {
+		presence.observe(e)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, userID := range e.Recipients {
+		for client := range h.clients[userID] {
+			select {
+			case client.send <- e:
+			default:
+				log.Printf("Клиент %s не успевает получать события, отключаем", userID)
+				go h.unsubscribe(client)
+			}
+		}
+	}
+}
+
+// publishEvent записывает событие в журнал и отправляет его подключенным клиентам.
+func publishEvent(eventType, chatID string, payload any, recipients []string) {
+	if hub == nil || len(recipients) == 0 {
+		return
+	}
+	e, err := newEvent(eventType, chatID, payload, recipients)
+	if err != nil {
+		log.Println("Ошибка подготовки события:", err)
+		return
+	}
+
+	// Без записи в журнал событие все равно уходит живым клиентам,
+	// просто его нельзя будет получить повторно после переподключения
+	err = db.QueryRow(`
+		INSERT INTO realtime_events (type, chat_id, payload, recipients)
+		VALUES ($1, NULLIF($2, '')::uuid, $3, $4)
+		RETURNING id
+	`, e.Type, e.ChatID, string(e.Payload), pq.Array(e.Recipients)).Scan(&e.ID)
+	if err != nil {
+		log.Println("Ошибка записи события в журнал:", err)
+	}
+
+	hub.Publish(e)
+}
+
+// loadLoggedEvent читает событие из журнала по номеру.
+func loadLoggedEvent(id int64) (Event, error) {
+	e := Event{ID: id}
+	var payload []byte
+	err := db.QueryRow(`
+		SELECT type, COALESCE(chat_id::text, ''), payload, recipients
+		FROM realtime_events
+		WHERE id = $1
+	`, id).Scan(&e.Type, &e.ChatID, &payload, pq.Array(&e.Recipients))
+	e.Payload = json.RawMessage(payload)
+	return e, err
+}
+
+// publishEphemeral отправляет событие подключенным клиентам без записи в журнал:
+// пропущенное при обрыве соединения уже неактуально.
+func publishEphemeral(eventType, chatID string, payload any, recipients []string) {
+	if hub == nil || len(recipients) == 0 {
+		return
+	}
+	e, err := newEvent(eventType, chatID, payload, recipients)
+	if err != nil {
+		log.Println("Ошибка подготовки события:", err)
+		return
+	}
+	hub.Publish(e)
+}
+
+// Сколько хранится журнал событий для догоняющих клиентов
+const eventLogRetention = 7 * 24 * time.Hour
+
+func cleanupEventLog(retention time.Duration) (int64, error) {
+	result, err := db.Exec("DELETE FROM realtime_events WHERE created_at < now() - make_interval(secs => $1)", retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Статусы доставки сообщения — «галочки» в приложении
+const (
+	receiptSent      = "sent"
+	receiptDelivered = "delivered"
+	receiptRead      = "read"
+)
+
+// MessageReceipt — доставка сообщения одному получателю.
+type MessageReceipt struct {
+	UserID      string     `json:"user_id"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+}
+
+// createReceipts заводит квитанции для всех участников чата, кроме отправителя.
+// У системных сообщений отправителя нет, и квитанции получают все.
+func createReceipts(tx *sql.Tx, messageID, senderID string, participants []string) error {
+	_, err := tx.Exec(`
+		INSERT INTO message_receipts (message_id, user_id)
+		SELECT $1, p FROM unnest($2::uuid[]) AS p
+		WHERE p IS DISTINCT FROM NULLIF($3, '')::uuid
+	`, messageID, pq.Array(participants), senderID)
+	return err
+}
+
+// attachReceipts дополняет сообщения квитанциями получателей и общим статусом:
+// delivered и read ставятся, когда их достигли все получатели.
+func attachReceipts(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+
+	rows, err := db.Query(`
+		SELECT message_id, user_id, delivered_at, read_at
+		FROM message_receipts
+		WHERE message_id = ANY($1::uuid[])
+		ORDER BY user_id
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	receipts := map[string][]MessageReceipt{}
+	for rows.Next() {
+		var messageID string
+		var r MessageReceipt
+		var delivered, read sql.NullTime
+		if err := rows.Scan(&messageID, &r.UserID, &delivered, &read); err != nil {
+			return err
+		}
+		if delivered.Valid {
+			r.DeliveredAt = &delivered.Time
+		}
+		if read.Valid {
+			r.ReadAt = &read.Time
+		}
+		receipts[messageID] = append(receipts[messageID], r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range messages {
+		messages[i].Receipts = receipts[messages[i].ID]
+		if messages[i].Receipts == nil {
+			messages[i].Receipts = []MessageReceipt{}
+		}
+		messages[i].Status = receiptStatus(messages[i].Receipts)
+	}
+	return nil
+}
+
+func receiptStatus(receipts []MessageReceipt) string {
+	if len(receipts) == 0 {
+		return receiptSent
+	}
+	status := receiptRead
+	for _, r := range receipts {
+		if r.DeliveredAt == nil {
+			return receiptSent
+		}
+		if r.ReadAt == nil {
+			status = receiptDelivered
+		}
+	}
+	return status
+}
+
+// acknowledgeMessages отмечает сообщения чата до номера upToSeq доставленными
+// или прочитанными пользователем. Прочтение подразумевает доставку.
+// Время однажды поставленной отметки не меняется.
+func acknowledgeMessages(tx *sql.Tx, chatID, userID string, upToSeq int64, status string) (time.Time, error) {
+	var at time.Time
+	err := tx.QueryRow(`
+		WITH acked AS (
+			UPDATE message_receipts r
+			SET delivered_at = COALESCE(r.delivered_at, now()),
+			    read_at = CASE WHEN $4 THEN COALESCE(r.read_at, now()) ELSE r.read_at END
+			FROM messages m
+			WHERE m.id = r.message_id AND m.chat_id = $1 AND m.seq <= $3 AND r.user_id = $2
+			RETURNING r.message_id
+		)
+		SELECT now()
+	`, chatID, userID, upToSeq, status == receiptRead).Scan(&at)
+	if err != nil || status != receiptRead {
+		return at, err
+	}
+
+	// Отметка прочтения чата нужна для счетчика непрочитанных и никогда не сдвигается назад
+	_, err = tx.Exec(`
+		INSERT INTO chat_reads (chat_id, user_id, last_read_seq, updated_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (chat_id, user_id) DO UPDATE
+		SET last_read_seq = GREATEST(chat_reads.last_read_seq, EXCLUDED.last_read_seq),
+		    updated_at = now()
+	`, chatID, userID, upToSeq)
+	return at, err
+}
+
+// POST /chats/:chat_id/delivered и /chats/:chat_id/read — подтвердить получение
+// или прочтение сообщений до message_id (или до номера seq) включительно.
+func acknowledgeHandler(status string) gin.HandlerFunc {
+	eventType := eventMessageDelivered
+	if status == receiptRead {
+		eventType = eventMessageRead
+	}
+
+	return func(c *gin.Context) {
+		chatID := c.Param("chat_id")
+		userID := currentUserID(c)
+
+		var request struct {
+			MessageID string `json:"message_id"`
+			Seq       int64  `json:"seq"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+			return
+		}
+		if _, err := uuid.Parse(chatID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+			return
+		}
+
+		var lastSeq int64
+		err := db.QueryRow(`
+			SELECT c.last_seq FROM chats c
+			WHERE c.id = $1 AND EXISTS (SELECT 1 FROM chat_members m WHERE m.chat_id = c.id AND m.user_id = $2)
+		`, chatID, userID).Scan(&lastSeq)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+			return
+		} else if err != nil {
+			log.Println("Ошибка проверки чата:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подтверждения сообщений"})
+			return
+		}
+
+		seq := request.Seq
+		if request.MessageID != "" {
+			if _, err := uuid.Parse(request.MessageID); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+				return
+			}
+			err := db.QueryRow("SELECT seq FROM messages WHERE id = $1 AND chat_id = $2", request.MessageID, chatID).Scan(&seq)
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+				return
+			} else if err != nil {
+				log.Println("Ошибка получения сообщения:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подтверждения сообщений"})
+				return
+			}
+		}
+		if seq <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Нужно указать message_id или seq"})
+			return
+		}
+		if seq > lastSeq {
+			seq = lastSeq
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подтверждения сообщений"})
+			return
+		}
+		defer tx.Rollback()
+
+		at, err := acknowledgeMessages(tx, chatID, userID, seq, status)
+		var participants []string
+		if err == nil {
+			participants, err = chatMembers(tx, chatID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Println("Ошибка подтверждения сообщений:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка подтверждения сообщений"})
+			return
+		}
+
+		publishEvent(eventType, chatID, gin.H{
+			"chat_id":   chatID,
+			"user_id":   userID,
+			"up_to_seq": seq,
+			"at":        at,
+		}, participants)
+
+		c.JSON(http.StatusOK, gin.H{"chat_id": chatID, "status": status, "up_to_seq": seq})
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Откуда жалоба: от пользователя или от фильтра сообщений
+const (
+	reportSourceUser   = "user"
+	reportSourceFilter = "filter"
+)
+
+// Статусы жалобы в очереди модератора
+const (
+	reportOpen      = "open"
+	reportDismissed = "dismissed"
+	reportActioned  = "actioned"
+)
+
+const maxReportReasonLength = 500
+
+// MessageReport — жалоба на сообщение вместе с самим сообщением для модератора.
+// В Message всегда исходный текст, даже если он был скрыт фильтром или сообщение удалено.
+type MessageReport struct {
+	ID            int64      `json:"id"`
+	Message       Message    `json:"message"`
+	SenderBlocked bool       `json:"sender_blocked"`
+	ReporterID    *string    `json:"reporter_id"`
+	Source        string     `json:"source"`
+	Reason        string     `json:"reason"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ResolvedBy    *string    `json:"resolved_by"`
+	ResolvedAt    *time.Time `json:"resolved_at"`
+	Resolution    *string    `json:"resolution"`
+}
+
+type MessagingBlock struct {
+	UserID    string     `json:"user_id"`
+	Reason    string     `json:"reason"`
+	BlockedBy *string    `json:"blocked_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// moderateMessage проверяет, что пользователю можно писать, и прогоняет текст через фильтры.
+// Если сообщение отправлять нельзя, ответ уже записан и ok == false.
+func moderateMessage(c *gin.Context, userID, text string) (result moderationResult, ok bool) {
+	var reason string
+	var expiresAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT reason, expires_at FROM messaging_blocks
+		WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > now())
+	`, userID).Scan(&reason, &expiresAt)
+	if err == nil {
+		response := gin.H{"error": "Вам запрещено отправлять сообщения", "reason": reason, "until": nil}
+		if expiresAt.Valid {
+			response["until"] = expiresAt.Time
+		}
+		c.JSON(http.StatusForbidden, response)
+		return result, false
+	} else if err != sql.ErrNoRows {
+		log.Println("Ошибка проверки блокировки:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки сообщения"})
+		return result, false
+	}
+
+	result = messageModeration.apply(text)
+	if result.Rejected != "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Сообщение не прошло проверку", "rule": result.Rejected})
+		return result, false
+	}
+	return result, true
+}
+
+// flagMessage ставит сообщение в очередь модератора по сработавшим фильтрам.
+func flagMessage(tx *sql.Tx, messageID string, flags []string) error {
+	for _, rule := range flags {
+		_, err := tx.Exec("INSERT INTO message_reports (message_id, source, reason) VALUES ($1, $2, $3)",
+			messageID, reportSourceFilter, "Сработал фильтр "+rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// POST /messages/:message_id/report — пожаловаться на сообщение из своего чата.
+// Повторная жалоба того же пользователя ничего не меняет.
+func reportMessageHandler(c *gin.Context) {
+	userID := currentUserID(c)
+	messageID := c.Param("message_id")
+
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	reason := strings.TrimSpace(request.Reason)
+	if reason == "" || len([]rune(reason)) > maxReportReasonLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Причина должна содержать от 1 до %d символов", maxReportReasonLength)})
+		return
+	}
+	if _, err := uuid.Parse(messageID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+		return
+	}
+
+	var senderID sql.NullString
+	err := db.QueryRow(`
+		SELECT m.sender_id FROM messages m
+		WHERE m.id = $1 AND EXISTS (SELECT 1 FROM chat_members cm WHERE cm.chat_id = m.chat_id AND cm.user_id = $2)
+	`, messageID, userID).Scan(&senderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Сообщение не найдено"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения сообщения:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки жалобы"})
+		return
+	}
+	if !senderID.Valid || senderID.String == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "На это сообщение нельзя пожаловаться"})
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO message_reports (message_id, reporter_id, source, reason)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (message_id, reporter_id) WHERE reporter_id IS NOT NULL DO NOTHING
+	`, messageID, userID, reportSourceUser, reason)
+	if err != nil {
+		log.Println("Ошибка сохранения жалобы:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки жалобы"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Жалоба отправлена"})
+}
+
+// GET /moderation/reports?status=open&limit=&offset= — очередь модератора, старые жалобы первыми.
+func getReportsHandler(c *gin.Context) {
+	status := c.DefaultQuery("status", reportOpen)
+	if status != reportOpen && status != reportDismissed && status != reportActioned {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status должен быть open, dismissed или actioned"})
+		return
+	}
+	limit, offset, ok := pageParams(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT r.id, r.reporter_id, r.source, r.reason, r.status, r.created_at, r.resolved_by, r.resolved_at, r.resolution,
+		       m.id, m.chat_id, m.sender_id, COALESCE(m.original_message, m.message), m.seq, m.created_at, m.deleted_at,
+		       EXISTS (SELECT 1 FROM messaging_blocks b
+		               WHERE b.user_id = m.sender_id AND (b.expires_at IS NULL OR b.expires_at > now()))
+		FROM message_reports r
+		JOIN messages m ON m.id = r.message_id
+		WHERE r.status = $1
+		ORDER BY r.created_at, r.id
+		LIMIT $2 OFFSET $3
+	`, status, limit, offset)
+	if err != nil {
+		log.Println("Ошибка получения жалоб:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения жалоб"})
+		return
+	}
+	defer rows.Close()
+
+	reports := []MessageReport{}
+	for rows.Next() {
+		var r MessageReport
+		var reporterID, resolvedBy, resolution, senderID sql.NullString
+		var resolvedAt, deletedAt sql.NullTime
+		err := rows.Scan(&r.ID, &reporterID, &r.Source, &r.Reason, &r.Status, &r.CreatedAt, &resolvedBy, &resolvedAt, &resolution,
+			&r.Message.ID, &r.Message.ChatID, &senderID, &r.Message.Message, &r.Message.Seq, &r.Message.CreatedAt, &deletedAt,
+			&r.SenderBlocked)
+		if err != nil {
+			log.Println("Ошибка обработки жалобы:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения жалоб"})
+			return
+		}
+		r.ReporterID = nullStringPtr(reporterID)
+		r.ResolvedBy = nullStringPtr(resolvedBy)
+		r.Resolution = nullStringPtr(resolution)
+		if resolvedAt.Valid {
+			r.ResolvedAt = &resolvedAt.Time
+		}
+		r.Message.SenderID = senderID.String
+		if deletedAt.Valid {
+			r.Message.DeletedAt = &deletedAt.Time
+		}
+		reports = append(reports, r)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка получения жалоб:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения жалоб"})
+		return
+	}
+
+	c.JSON(http.StatusOK, reports)
+}
+
+// pageParams читает limit и offset. При ошибке ответ уже записан и ok == false.
+func pageParams(c *gin.Context, defaultLimit, maxLimit int) (limit, offset int, ok bool) {
+	limit = defaultLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit должен быть от 1 до %d", maxLimit)})
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный offset"})
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+// blockUser запрещает пользователю писать сообщения. days == 0 — бессрочно.
+func blockUser(q querier, userID, reason, blockedBy string, days int) error {
+	_, err := q.Exec(`
+		INSERT INTO messaging_blocks (user_id, reason, blocked_by, expires_at)
+		VALUES ($1, $2, $3, CASE WHEN $4 > 0 THEN now() + make_interval(days => $4) END)
+		ON CONFLICT (user_id) DO UPDATE
+		SET reason = EXCLUDED.reason, blocked_by = EXCLUDED.blocked_by,
+		    created_at = now(), expires_at = EXCLUDED.expires_at
+	`, userID, reason, blockedBy, days)
+	return err
+}
+
+// POST /moderation/reports/:id/resolve — решение по жалобе. Закрывает все открытые
+// жалобы на то же сообщение. Без действий жалоба отклоняется.
+func resolveReportHandler(c *gin.Context) {
+	moderatorID := currentUserID(c)
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Жалоба не найдена"})
+		return
+	}
+	var request struct {
+		DeleteMessage bool   `json:"delete_message"`
+		BlockSender   bool   `json:"block_sender"`
+		BlockDays     int    `json:"block_days"` // 0 — бессрочно
+		Note          string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	if request.BlockDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "block_days не может быть отрицательным"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки жалобы"})
+		return
+	}
+	defer tx.Rollback()
+
+	var messageID, chatID string
+	var senderID sql.NullString
+	var seq int64
+	var alreadyDeleted bool
+	var reportStatus string
+	// Блокировка сообщения упорядочивает обработку всех жалоб на него:
+	// второй модератор дождется первого и увидит, что жалоба уже закрыта
+	err = tx.QueryRow(`
+		SELECT m.id, m.chat_id, m.sender_id, m.seq, m.deleted_at IS NOT NULL, r.status
+		FROM message_reports r
+		JOIN messages m ON m.id = r.message_id
+		WHERE r.id = $1
+		FOR UPDATE OF m, r
+	`, id).Scan(&messageID, &chatID, &senderID, &seq, &alreadyDeleted, &reportStatus)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Жалоба не найдена"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения жалобы:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки жалобы"})
+		return
+	}
+	if reportStatus != reportOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": "Жалоба уже обработана", "status": reportStatus})
+		return
+	}
+
+	var actions []string
+	deleted := false
+	if request.DeleteMessage && !alreadyDeleted {
+		if _, err = tx.Exec("UPDATE messages SET deleted_at = now() WHERE id = $1", messageID); err == nil {
+			deleted = true
+			actions = append(actions, "сообщение удалено")
+		}
+	}
+	if err == nil && request.BlockSender && senderID.Valid {
+		reason := strings.TrimSpace(request.Note)
+		if reason == "" {
+			reason = "Нарушение правил общения"
+		}
+		if err = blockUser(tx, senderID.String, reason, moderatorID, request.BlockDays); err == nil {
+			actions = append(actions, "отправитель заблокирован")
+		}
+	}
+
+	status := reportDismissed
+	if len(actions) > 0 {
+		status = reportActioned
+	}
+	resolution := strings.Join(actions, ", ")
+	if note := strings.TrimSpace(request.Note); note != "" {
+		resolution = strings.TrimPrefix(resolution+". "+note, ". ")
+	}
+
+	var resolved int64
+	if err == nil {
+		var res sql.Result
+		res, err = tx.Exec(`
+			UPDATE message_reports
+			SET status = $1, resolved_by = $2, resolved_at = now(), resolution = NULLIF($3, '')
+			WHERE message_id = $4 AND status = 'open'
+		`, status, moderatorID, resolution, messageID)
+		if err == nil {
+			resolved, _ = res.RowsAffected()
+		}
+	}
+	if err == nil && resolved == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Жалоба уже обработана"})
+		return
+	}
+	var participants []string
+	if err == nil && deleted {
+		participants, err = chatMembers(tx, chatID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Ошибка обработки жалобы:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки жалобы"})
+		return
+	}
+
+	if deleted {
+		publishEvent(eventMessageDeleted, chatID, gin.H{
+			"message_id": messageID,
+			"chat_id":    chatID,
+			"seq":        seq,
+			"scope":      deleteForEveryone,
+		}, participants)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Жалоба обработана", "status": status, "resolved_reports": resolved})
+}
+
+// GET /moderation/blocks — действующие блокировки.
+func getMessagingBlocksHandler(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT user_id, reason, blocked_by, created_at, expires_at
+		FROM messaging_blocks
+		WHERE expires_at IS NULL OR expires_at > now()
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		log.Println("Ошибка получения блокировок:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения блокировок"})
+		return
+	}
+	defer rows.Close()
+
+	blocks := []MessagingBlock{}
+	for rows.Next() {
+		var b MessagingBlock
+		var blockedBy sql.NullString
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&b.UserID, &b.Reason, &blockedBy, &b.CreatedAt, &expiresAt); err != nil {
+			log.Println("Ошибка обработки блокировки:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения блокировок"})
+			return
+		}
+		b.BlockedBy = nullStringPtr(blockedBy)
+		if expiresAt.Valid {
+			b.ExpiresAt = &expiresAt.Time
+		}
+		blocks = append(blocks, b)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка получения блокировок:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения блокировок"})
+		return
+	}
+
+	c.JSON(http.StatusOK, blocks)
+}
+
+// POST /moderation/blocks — запретить пользователю писать сообщения.
+func blockUserHandler(c *gin.Context) {
+	var request struct {
+		UserID string `json:"user_id"`
+		Reason string `json:"reason"`
+		Days   int    `json:"days"` // 0 — бессрочно
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	userID, err := uuid.Parse(request.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный user_id"})
+		return
+	}
+	reason := strings.TrimSpace(request.Reason)
+	if reason == "" || len([]rune(reason)) > maxReportReasonLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Причина должна содержать от 1 до %d символов", maxReportReasonLength)})
+		return
+	}
+	if request.Days < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days не может быть отрицательным"})
+		return
+	}
+
+	if err := blockUser(db, userID.String(), reason, currentUserID(c), request.Days); err != nil {
+		log.Println("Ошибка блокировки пользователя:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка блокировки пользователя"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Пользователь заблокирован", "user_id": userID.String()})
+}
+
+// DELETE /moderation/blocks/:user_id — снять блокировку.
+func unblockUserHandler(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Блокировка не найдена"})
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM messaging_blocks WHERE user_id = $1", userID.String())
+	if err != nil {
+		log.Println("Ошибка снятия блокировки:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка снятия блокировки"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Блокировка не найдена"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Действия, которые попадают в историю квартиры
+const (
+	revisionCreate   = "create"
+	revisionUpdate   = "update"
+	revisionDelete   = "delete"
+	revisionRestore  = "restore"
+	revisionRollback = "rollback"
+)
+
+type fieldChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+type ApartmentRevision struct {
+	ID             int64                  `json:"id"`
+	ApartmentID    int                    `json:"apartment_id"`
+	Version        int                    `json:"version"`
+	Action         string                 `json:"action"`
+	ChangedBy      *string                `json:"changed_by"`
+	ChangedAt      time.Time              `json:"changed_at"`
+	SourceRevision *int64                 `json:"source_revision_id,omitempty"`
+	Before         *Apartment             `json:"before"`
+	After          *Apartment             `json:"after"`
+	Changes        map[string]fieldChange `json:"changes"`
+}
+
+// apartmentDiff сравнивает два снимка квартиры поле за полем.
+// Версия не считается изменением: она меняется всегда.
+func apartmentDiff(before, after *Apartment) map[string]fieldChange {
+	toMap := func(a *Apartment) map[string]any {
+		m := map[string]any{}
+		if a == nil {
+			return m
+		}
+		data, _ := json.Marshal(a)
+		json.Unmarshal(data, &m)
+		delete(m, "version")
+		return m
+	}
+
+	b, a := toMap(before), toMap(after)
+	changes := map[string]fieldChange{}
+	for field, value := range a {
+		if old, ok := b[field]; !ok || old != value {
+			changes[field] = fieldChange{Before: b[field], After: value}
+		}
+	}
+	for field, old := range b {
+		if _, ok := a[field]; !ok {
+			changes[field] = fieldChange{Before: old, After: nil}
+		}
+	}
+	return changes
+}
+
+func recordApartmentRevision(tx *sql.Tx, action, changedBy string, sourceRevision *int64, before, after *Apartment) error {
+	var beforeJSON, afterJSON []byte
+	if before != nil {
+		beforeJSON, _ = json.Marshal(before)
+	}
+	if after != nil {
+		afterJSON, _ = json.Marshal(after)
+	}
+	changes, _ := json.Marshal(apartmentDiff(before, after))
+
+	var by sql.NullString
+	if changedBy != "" {
+		by = sql.NullString{String: changedBy, Valid: true}
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO apartment_revisions (apartment_id, version, action, changed_by, source_revision_id, before, after, changes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, after.ID, after.Version, action, by, sourceRevision, nullJSON(beforeJSON), nullJSON(afterJSON), changes)
+	if err != nil {
+		return err
+	}
+
+	// Каждое изменение квартиры проходит через историю, поэтому и событие для партнеров пишется здесь.
+	// Если у квартиры сменился хозяин, о ней узнают оба
+	var audience []string
+	for _, a := range []*Apartment{before, after} {
+		if a != nil && a.HostID != nil && !slices.Contains(audience, *a.HostID) {
+			audience = append(audience, *a.HostID)
+		}
+	}
+	return enqueueOutbox(tx, apartmentEventType(action), gin.H{
+		"action":    action,
+		"apartment": after,
+		"changes":   json.RawMessage(changes),
+	}, audience)
+}
+
+func nullJSON(data []byte) any {
+	if data == nil {
+		return nil
+	}
+	return string(data)
+}
+
+// changeApartment блокирует строку квартиры, выполняет изменение и записывает ревизию
+// в одной транзакции. Если apply не нашел строку (нет квартиры или не совпала версия),
+// возвращается sql.ErrNoRows.
+func changeApartment(id any, action, changedBy string, sourceRevision *int64, apply func(tx *sql.Tx) (*Apartment, error)) (*Apartment, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	after, err := changeApartmentTx(tx, id, action, changedBy, sourceRevision, apply)
+	if err != nil {
+		return nil, err
+	}
+
+	return after, tx.Commit()
+}
+
+// errApartmentNotOwned возвращает changeOwnApartment, если квартира чужая.
+// Обработчики отвечают на нее 404, чтобы не раскрывать чужие квартиры.
+var errApartmentNotOwned = errors.New("квартира принадлежит другому хозяину")
+
+// canManageApartment — может ли пользователь менять квартиру: только хозяин или администратор.
+func canManageApartment(c *gin.Context, hostID *string) bool {
+	if c.GetString("role") == "admin" {
+		return true
+	}
+	return hostID != nil && *hostID == currentUserID(c)
+}
+
+// changeOwnApartment делает то же, что changeApartment, от имени текущего пользователя,
+// но сначала проверяет хозяина уже заблокированной строки. Для чужой квартиры
+// возвращается errApartmentNotOwned.
+func changeOwnApartment(c *gin.Context, id any, action string, apply func(tx *sql.Tx) (*Apartment, error)) (*Apartment, error) {
+	return changeApartment(id, action, currentUserID(c), nil, func(tx *sql.Tx) (*Apartment, error) {
+		// Строку уже держит FOR UPDATE из changeApartmentTx, хозяин не сменится до конца транзакции
+		var hostID sql.NullString
+		if err := tx.QueryRow("SELECT host_id FROM apartments WHERE id = $1", id).Scan(&hostID); err != nil {
+			return nil, err
+		}
+		if !canManageApartment(c, nullStringPtr(hostID)) {
+			return nil, errApartmentNotOwned
+		}
+		return apply(tx)
+	})
+}
+
+// changeApartmentTx делает то же, что changeApartment, внутри уже открытой транзакции.
+func changeApartmentTx(tx *sql.Tx, id any, action, changedBy string, sourceRevision *int64, apply func(tx *sql.Tx) (*Apartment, error)) (*Apartment, error) {
+	var before Apartment
+	err := scanApartment(tx.QueryRow("SELECT "+apartmentColumns+" FROM apartments WHERE id = $1 FOR UPDATE", id), &before)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := apply(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordApartmentRevision(tx, action, changedBy, sourceRevision, &before, after); err != nil {
+		return nil, err
+	}
+
+	return after, nil
+}
+
+const revisionColumns = "id, apartment_id, version, action, changed_by, changed_at, source_revision_id, before, after, changes"
+
+func scanRevision(row rowScanner, r *ApartmentRevision) error {
+	var changedBy sql.NullString
+	var source sql.NullInt64
+	var before, after, changes []byte
+	if err := row.Scan(&r.ID, &r.ApartmentID, &r.Version, &r.Action, &changedBy, &r.ChangedAt, &source, &before, &after, &changes); err != nil {
+		return err
+	}
+	if changedBy.Valid {
+		r.ChangedBy = &changedBy.String
+	}
+	if source.Valid {
+		r.SourceRevision = &source.Int64
+	}
+	if before != nil {
+		r.Before = &Apartment{}
+		if err := json.Unmarshal(before, r.Before); err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		r.After = &Apartment{}
+		if err := json.Unmarshal(after, r.After); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(changes, &r.Changes)
+}
+
+// GET /apartments/:id/history?limit=&offset= — для хозяина квартиры и администратора
+func getApartmentHistoryHandler(c *gin.Context) {
+	id := c.Param("id")
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit должен быть от 1 до 200"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный offset"})
+		return
+	}
+
+	// В истории видно, кто менял квартиру, поэтому она доступна только хозяину и администратору
+	var hostID sql.NullString
+	err = db.QueryRow("SELECT host_id FROM apartments WHERE id = $1 AND deleted_at IS NULL", id).Scan(&hostID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка проверки квартиры:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории"})
+		return
+	}
+	if c.GetString("role") != "admin" && hostID.String != currentUserID(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+revisionColumns+`
+		FROM apartment_revisions
+		WHERE apartment_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+	`, id, limit, offset)
+	if err != nil {
+		log.Println("Ошибка получения истории квартиры:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории"})
+		return
+	}
+	defer rows.Close()
+
+	revisions := []ApartmentRevision{}
+	for rows.Next() {
+		var r ApartmentRevision
+		if err := scanRevision(rows, &r); err != nil {
+			log.Println("Ошибка обработки ревизии:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки истории"})
+			return
+		}
+		revisions = append(revisions, r)
+	}
+
+	c.JSON(http.StatusOK, revisions)
+}
+
+// GET /apartments/:id/prices — как менялась цена квартиры.
+// Историю удаленной квартиры видит только администратор.
+func getApartmentPriceHistoryHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	}
+
+	var exists bool
+	err = db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM apartments WHERE id = $1 AND (deleted_at IS NULL OR $2))",
+		id, c.GetString("role") == "admin",
+	).Scan(&exists)
+	if err != nil {
+		log.Println("Ошибка проверки квартиры:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории цен"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Квартира не найдена"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT (after->>'price')::numeric, changed_at, version
+		FROM apartment_revisions
+		WHERE apartment_id = $1
+		  AND after IS NOT NULL
+		  AND (before IS NULL OR changes ? 'price')
+		ORDER BY id
+	`, id)
+	if err != nil {
+		log.Println("Ошибка получения истории цен:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории цен"})
+		return
+	}
+	defer rows.Close()
+
+	timeline := []gin.H{}
+	for rows.Next() {
+		var price float64
+		var changedAt time.Time
+		var version int
+		if err := rows.Scan(&price, &changedAt, &version); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обработки истории цен"})
+			return
+		}
+		timeline = append(timeline, gin.H{"price": price, "changed_at": changedAt, "version": version})
+	}
+
+	c.JSON(http.StatusOK, timeline)
+}
+
+// POST /admin/apartments/:id/rollback/:revision_id — вернуть квартиру к состоянию после ревизии
+func rollbackApartmentHandler(c *gin.Context) {
+	id := c.Param("id")
+	revisionID, err := strconv.ParseInt(c.Param("revision_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ревизия не найдена"})
+		return
+	}
+
+	var revision ApartmentRevision
+	err = scanRevision(db.QueryRow("SELECT "+revisionColumns+" FROM apartment_revisions WHERE id = $1 AND apartment_id = $2", revisionID, id), &revision)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ревизия не найдена"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка получения ревизии:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения ревизии"})
+		return
+	}
+	if revision.After == nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "К этой ревизии нельзя откатиться"})
+		return
+	}
+
+	target := revision.After
+	versions := ifMatchVersions(c)
+	apartment, err := changeApartment(id, revisionRollback, currentUserID(c), &revision.ID, func(tx *sql.Tx) (*Apartment, error) {
+		var a Apartment
+		err := scanApartment(tx.QueryRow(`
+			UPDATE apartments
+			SET title = $1, address = $2, image_link = $3, description = $4,
+			    square_meters = $5, bedrooms = $6, price = $7, favourite = $8,
+			    version = version + 1
+			WHERE id = $9 AND deleted_at IS NULL
+			  AND ($10::bigint[] IS NULL OR version = ANY($10::bigint[]))
+			RETURNING `+apartmentColumns,
+			target.Title, target.Address, target.ImageLink, target.Description,
+			target.SquareMeters, target.Bedrooms, target.Price, target.Favourite, id, pq.Array(versions)), &a)
+		return &a, err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondApartmentMiss(c, id, versions)
+		return
+	} else if err != nil {
+		log.Println("Ошибка отката квартиры:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отката квартиры"})
+		return
+	}
+
+	c.Header("ETag", versionETag(apartment.Version))
+	c.JSON(http.StatusOK, apartment)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Задачи по расписанию выполняет только ведущий узел — тот, кто держит
+// advisory-блокировку с этим ключом. Если он остановится, блокировка
+// освободится вместе с его соединением и ведущим станет другой узел.
+const schedulerLockKey int64 = 0x5343484544 // "SCHED"
+
+const (
+	schedulerTick      = 15 * time.Second
+	taskDefaultTimeout = 10 * time.Minute
+	// Сколько хранится история запусков
+	taskRunRetention = 30 * 24 * time.Hour
+)
+
+// Как запущена задача
+const (
+	taskTriggerSchedule = "schedule"
+	taskTriggerManual   = "manual"
+)
+
+// scheduledTask — периодическая задача. run возвращает краткий итог для истории запусков.
+type scheduledTask struct {
+	name        string
+	description string
+	schedule    *cronSchedule
+	timeout     time.Duration
+	run         func(ctx context.Context) (string, error)
+}
+
+func newScheduledTask(name, spec, description string, run func(ctx context.Context) (string, error)) *scheduledTask {
+	schedule, err := parseCron(spec)
+	if err != nil {
+		panic(err)
+	}
+	return &scheduledTask{name: name, description: description, schedule: schedule, timeout: taskDefaultTimeout, run: run}
+}
+
+// countResult превращает функцию очистки, которая возвращает число записей, в задачу.
+func countResult[N int | int64](format string, fn func() (N, error)) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		n, err := fn()
+		return fmt.Sprintf(format, n), err
+	}
+}
+
+// Время в расписаниях — местное время сервера
+var scheduledTasks = []*scheduledTask{
+	newScheduledTask("orders.complete", "10 * * * *", "Завершение заказов после даты выезда",
+		func(ctx context.Context) (string, error) {
+			n, err := completeFinishedOrders(ctx)
+			return fmt.Sprintf("Завершено заказов: %d", n), err
+		}),
+	newScheduledTask("bookings.remind", "0 9-21 * * *", "Напоминания гостям за день до заезда",
+		func(ctx context.Context) (string, error) {
+			n, err := sendBookingReminders(ctx)
+			return fmt.Sprintf("Отправлено напоминаний: %d", n), err
+		}),
+	newScheduledTask("carts.purge", "30 3 * * *", "Очистка брошенных корзин",
+		countResult("Удалено позиций корзин: %d", func() (int64, error) { return purgeExpiredCarts(cartRetention) })),
+	newScheduledTask("apartments.purge", "0 4 * * *", "Окончательное удаление квартир после срока хранения",
+		countResult("Удалено квартир: %d", func() (int64, error) { return purgeDeletedApartments(apartmentRetention) })),
+	newScheduledTask("realtime_events.cleanup", "15 * * * *", "Очистка журнала событий реального времени",
+		countResult("Удалено событий: %d", func() (int64, error) { return cleanupEventLog(eventLogRetention) })),
+	newScheduledTask("attachments.cleanup", "20 * * * *", "Удаление неотправленных вложений",
+		countResult("Удалено вложений: %d", func() (int, error) { return cleanupUnsentAttachments(unsentAttachmentRetention) })),
+	newScheduledTask("webhooks.cleanup", "25 * * * *", "Очистка журнала вебхуков и outbox",
+		countResult("Удалено записей: %d", cleanupWebhookLog)),
+	newScheduledTask("jobs.cleanup", "45 * * * *", "Удаление завершенных фоновых задач",
+		countResult("Удалено задач: %d", func() (int64, error) { return cleanupJobs(jobRetention) })),
+}
+
+func findScheduledTask(name string) *scheduledTask {
+	for _, t := range scheduledTasks {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+type scheduler struct {
+	// Соединение, на котором держится блокировка ведущего; nil, если узел не ведущий
+	conn *sql.Conn
+
+	mu      sync.Mutex
+	running map[string]bool
+
+	wg sync.WaitGroup
+	// Отменяется, если при остановке задачи не успели завершиться
+	taskCtx     context.Context
+	cancelTasks context.CancelFunc
+	stopped     chan struct{}
+}
+
+// startScheduler запускает проверку расписания. Новые запуски прекращаются,
+// когда ctx отменен; дождаться уже начатых можно через shutdown.
+func startScheduler(ctx context.Context) *scheduler {
+	s := &scheduler{running: map[string]bool{}, stopped: make(chan struct{})}
+	s.taskCtx, s.cancelTasks = context.WithCancel(context.Background())
+	go s.loop(ctx)
+	return s
+}
+
+func (s *scheduler) loop(ctx context.Context) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+
+	for {
+		if s.lead(ctx) {
+			if err := s.runDue(); err != nil {
+				log.Println("Ошибка проверки расписания:", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lead проверяет, что узел остается ведущим, или пытается им стать.
+func (s *scheduler) lead(ctx context.Context) bool {
+	if s.conn != nil {
+		if err := s.conn.PingContext(ctx); err == nil {
+			return true
+		}
+		log.Println("Соединение ведущего планировщика потеряно")
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", schedulerLockKey).Scan(&locked); err != nil || !locked {
+		if err != nil && ctx.Err() == nil {
+			log.Println("Ошибка выбора ведущего планировщика:", err)
+		}
+		conn.Close()
+		return false
+	}
+	s.conn = conn
+	log.Println("Узел стал ведущим планировщиком")
+
+	if err := syncScheduledTasks(); err != nil {
+		log.Println("Ошибка подготовки расписания:", err)
+	}
+	return true
+}
+
+// syncScheduledTasks заводит строки для новых задач и подтягивает время следующего
+// запуска, если расписание в коде стало чаще. Запуски, которые прервал прежний
+// ведущий, отмечаются неудачными.
+func syncScheduledTasks() error {
+	now := time.Now()
+	for _, t := range scheduledTasks {
+		_, err := db.Exec(`
+			INSERT INTO scheduled_tasks (name, next_run_at) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET next_run_at = LEAST(scheduled_tasks.next_run_at, EXCLUDED.next_run_at)
+		`, t.name, t.schedule.next(now))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(`
+		UPDATE scheduled_task_runs
+		SET status = 'failed', error = 'Узел остановился во время выполнения', finished_at = now()
+		WHERE status = 'running'
+	`)
+	return err
+}
+
+// runDue запускает задачи, которым пора по расписанию или которые запросили вручную.
+// Задача, которая еще выполняется, второй раз не запускается.
+func (s *scheduler) runDue() error {
+	rows, err := db.Query(`
+		SELECT name, next_run_at <= now(), requested_by
+		FROM scheduled_tasks
+		WHERE next_run_at <= now() OR run_requested_at IS NOT NULL
+	`)
+	if err != nil {
+		return err
+	}
+	type dueTask struct {
+		task        *scheduledTask
+		scheduled   bool
+		requestedBy sql.NullString
+	}
+	var due []dueTask
+	for rows.Next() {
+		var name string
+		var d dueTask
+		if err := rows.Scan(&name, &d.scheduled, &d.requestedBy); err != nil {
+			rows.Close()
+			return err
+		}
+		// Задачи, которых больше нет в коде, пропускаем
+		if d.task = findScheduledTask(name); d.task != nil {
+			due = append(due, d)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		s.mu.Lock()
+		busy := s.running[d.task.name]
+		s.mu.Unlock()
+		if busy {
+			continue
+		}
+
+		// Запуски, пропущенные за время простоя, не повторяются: следующий считается от текущего момента
+		trigger := taskTriggerManual
+		if d.scheduled {
+			trigger = taskTriggerSchedule
+		}
+		_, err := db.Exec(`
+			UPDATE scheduled_tasks
+			SET next_run_at = CASE WHEN $2 THEN $3 ELSE next_run_at END,
+			    run_requested_at = NULL, requested_by = NULL
+			WHERE name = $1
+		`, d.task.name, d.scheduled, d.task.schedule.next(time.Now()))
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.running[d.task.name] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.execute(d.task, trigger, d.requestedBy)
+	}
+	return nil
+}
+
+func (s *scheduler) execute(t *scheduledTask, trigger string, triggeredBy sql.NullString) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, t.name)
+		s.mu.Unlock()
+	}()
+
+	var runID int64
+	err := db.QueryRow(`
+		INSERT INTO scheduled_task_runs (task, trigger, triggered_by, node) VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, t.name, trigger, triggeredBy, hub.node).Scan(&runID)
+	if err != nil {
+		log.Printf("Ошибка записи запуска задачи %s: %v", t.name, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.taskCtx, t.timeout)
+	result, runErr := runScheduledTask(ctx, t)
+	cancel()
+
+	status, errText := "succeeded", sql.NullString{}
+	if runErr != nil {
+		log.Printf("Ошибка задачи %s: %v", t.name, runErr)
+		status, errText = "failed", sql.NullString{String: runErr.Error(), Valid: true}
+	}
+	_, err = db.Exec(`
+		UPDATE scheduled_task_runs SET status = $2, result = NULLIF($3, ''), error = $4, finished_at = now()
+		WHERE id = $1
+	`, runID, status, result, errText)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM scheduled_task_runs WHERE task = $1 AND started_at < now() - make_interval(secs => $2)",
+			t.name, taskRunRetention.Seconds())
+	}
+	if err != nil {
+		log.Printf("Ошибка записи результата задачи %s: %v", t.name, err)
+	}
+}
+
+// runScheduledTask выполняет задачу; паника в ней считается ошибкой.
+func runScheduledTask(ctx context.Context, t *scheduledTask) (result string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Паника в задаче %s: %v\n%s", t.name, p, debug.Stack())
+			err = fmt.Errorf("паника: %v", p)
+		}
+	}()
+	return t.run(ctx)
+}
+
+// shutdown ждет, пока завершатся начатые задачи, и отдает роль ведущего.
+// Проверка расписания к этому моменту должна быть остановлена отменой
+// контекста из startScheduler. Если ctx истекает раньше, задачи отменяются.
+func (s *scheduler) shutdown(ctx context.Context) error {
+	<-s.stopped
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.cancelTasks()
+		<-done
+		err = ctx.Err()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// ScheduledTaskInfo — задача в списке для администратора.
+type ScheduledTaskInfo struct {
+	Name         string            `json:"name"`
+	Description  string            `json:"description"`
+	Schedule     string            `json:"schedule"`
+	NextRunAt    *time.Time        `json:"next_run_at"`
+	RunRequested bool              `json:"run_requested"`
+	LastRun      *ScheduledTaskRun `json:"last_run"`
+}
+
+type ScheduledTaskRun struct {
+	ID          int64      `json:"id"`
+	Task        string     `json:"task"`
+	Trigger     string     `json:"trigger"`
+	TriggeredBy *string    `json:"triggered_by"`
+	Status      string     `json:"status"`
+	Result      *string    `json:"result"`
+	Error       *string    `json:"error"`
+	Node        string     `json:"node"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+}
+
+const scheduledTaskRunColumns = "id, task, trigger, triggered_by, status, result, error, node, started_at, finished_at"
+
+func scanScheduledTaskRun(row rowScanner, r *ScheduledTaskRun) error {
+	var triggeredBy, result, errText sql.NullString
+	var finished sql.NullTime
+	err := row.Scan(&r.ID, &r.Task, &r.Trigger, &triggeredBy, &r.Status, &result, &errText, &r.Node, &r.StartedAt, &finished)
+	if err != nil {
+		return err
+	}
+	r.TriggeredBy = nullStringPtr(triggeredBy)
+	r.Result = nullStringPtr(result)
+	r.Error = nullStringPtr(errText)
+	r.FinishedAt = nil
+	if finished.Valid {
+		r.FinishedAt = &finished.Time
+	}
+	return nil
+}
+
+// GET /admin/tasks — задачи по расписанию с последним запуском
+func getScheduledTasksHandler(c *gin.Context) {
+	tasks := make([]ScheduledTaskInfo, 0, len(scheduledTasks))
+	for _, t := range scheduledTasks {
+		info := ScheduledTaskInfo{Name: t.name, Description: t.description, Schedule: t.schedule.spec}
+
+		var next sql.NullTime
+		err := db.QueryRow("SELECT next_run_at, run_requested_at IS NOT NULL FROM scheduled_tasks WHERE name = $1", t.name).
+			Scan(&next, &info.RunRequested)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("Ошибка получения задач:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения задач"})
+			return
+		}
+		if next.Valid {
+			info.NextRunAt = &next.Time
+		}
+
+		var run ScheduledTaskRun
+		err = scanScheduledTaskRun(db.QueryRow("SELECT "+scheduledTaskRunColumns+" FROM scheduled_task_runs WHERE task = $1 ORDER BY id DESC LIMIT 1", t.name), &run)
+		if err == nil {
+			info.LastRun = &run
+		} else if err != sql.ErrNoRows {
+			log.Println("Ошибка получения задач:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения задач"})
+			return
+		}
+		tasks = append(tasks, info)
+	}
+
+	c.JSON(http.StatusOK, tasks)
+}
+
+// GET /admin/tasks/:name/runs?limit=&offset= — история запусков, новые первыми
+func getScheduledTaskRunsHandler(c *gin.Context) {
+	t := findScheduledTask(c.Param("name"))
+	if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Задача не найдена"})
+		return
+	}
+	limit, offset, ok := pageParams(c, 50, 200)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query("SELECT "+scheduledTaskRunColumns+" FROM scheduled_task_runs WHERE task = $1 ORDER BY id DESC LIMIT $2 OFFSET $3",
+		t.name, limit+1, offset)
+	if err != nil {
+		log.Println("Ошибка получения истории задачи:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории задачи"})
+		return
+	}
+	defer rows.Close()
+
+	runs := []ScheduledTaskRun{}
+	for rows.Next() {
+		var r ScheduledTaskRun
+		if err := scanScheduledTaskRun(rows, &r); err != nil {
+			log.Println("Ошибка обработки запуска задачи:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории задачи"})
+			return
+		}
+		runs = append(runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка получения истории задачи:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения истории задачи"})
+		return
+	}
+
+	hasMore := len(runs) > limit
+	if hasMore {
+		runs = runs[:limit]
+	}
+	c.Header("X-Has-More", strconv.FormatBool(hasMore))
+	c.JSON(http.StatusOK, runs)
+}
+
+// POST /admin/tasks/:name/run — запустить задачу вне расписания.
+// Ее выполнит ведущий узел при следующей проверке; итог появится в истории запусков.
+func runScheduledTaskHandler(c *gin.Context) {
+	t := findScheduledTask(c.Param("name"))
+	if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Задача не найдена"})
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO scheduled_tasks (name, next_run_at, run_requested_at, requested_by) VALUES ($1, $2, now(), $3)
+		ON CONFLICT (name) DO UPDATE
+		SET run_requested_at = COALESCE(scheduled_tasks.run_requested_at, now()), requested_by = EXCLUDED.requested_by
+	`, t.name, t.schedule.next(time.Now()), currentUserID(c))
+	if err != nil {
+		log.Println("Ошибка запуска задачи:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка запуска задачи"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Задача будет запущена", "task": t.name})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	maxSearchQueryLength = 200
+	defaultSearchPage    = 20
+	maxSearchPage        = 100
+	defaultSearchContext = 2
+	maxSearchContext     = 5
+)
+
+// Найденные слова в highlight обрамляются этими метками, клиент подсвечивает их сам
+const (
+	searchHighlightStart = "<<"
+	searchHighlightStop  = ">>"
+)
+
+// SearchHit — найденное сообщение и соседние сообщения чата вокруг него.
+type SearchHit struct {
+	Message   Message   `json:"message"`
+	Highlight string    `json:"highlight"`
+	Before    []Message `json:"before"`
+	After     []Message `json:"after"`
+}
+
+// ChatSearchResult — найденные сообщения одного чата, самые свежие первыми.
+type ChatSearchResult struct {
+	ChatID       string            `json:"chat_id"`
+	Kind         string            `json:"kind"`
+	Title        *string           `json:"title"`
+	Participants []ChatParticipant `json:"participants"`
+	ApartmentID  *int              `json:"apartment_id"`
+	OrderID      *int              `json:"order_id"`
+	Hits         []SearchHit       `json:"hits"`
+}
+
+// GET /search/messages?q=&chat_id=&context=&limit=&offset=
+// Ищет по сообщениям чатов, в которых состоит пользователь. q понимает синтаксис
+// веб-поиска: "фраза в кавычках", or, -исключение. Страница считается по найденным
+// сообщениям, а в ответе они сгруппированы по чатам; X-Has-More говорит, есть ли еще.
+// Удаленные, скрытые пользователем и системные сообщения не ищутся.
+func searchMessagesHandler(c *gin.Context) {
+	userID := currentUserID(c)
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" || utf8.RuneCountInString(query) > maxSearchQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Запрос должен содержать от 1 до %d символов", maxSearchQueryLength)})
+		return
+	}
+	chatID := c.Query("chat_id")
+	if chatID != "" {
+		if _, err := uuid.Parse(chatID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Чат не найден"})
+			return
+		}
+	}
+	contextSize := defaultSearchContext
+	if v := c.Query("context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxSearchContext {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("context должен быть от 0 до %d", maxSearchContext)})
+			return
+		}
+		contextSize = n
+	}
+	limit, offset, ok := pageParams(c, defaultSearchPage, maxSearchPage)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+messageColumns+`,
+		       ts_headline('russian', message, q, $6)
+		FROM messages, websearch_to_tsquery('russian', $2) AS q
+		WHERE search_vector @@ q
+		  AND kind = 'user' AND deleted_at IS NULL
+		  AND ($3 = '' OR chat_id = NULLIF($3, '')::uuid)
+		  AND EXISTS (SELECT 1 FROM chat_members cm WHERE cm.chat_id = messages.chat_id AND cm.user_id = $1)
+		  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = $1)
+		ORDER BY created_at DESC, id
+		LIMIT $4 OFFSET $5
+	`, userID, query, chatID, limit+1, offset,
+		"StartSel="+searchHighlightStart+", StopSel="+searchHighlightStop+", MaxWords=30, MinWords=10, MaxFragments=2")
+	if err != nil {
+		log.Println("Ошибка поиска сообщений:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка поиска сообщений"})
+		return
+	}
+	defer rows.Close()
+
+	hits := []SearchHit{}
+	for rows.Next() {
+		var h SearchHit
+		if err := scanMessage(rows, &h.Message, &h.Highlight); err != nil {
+			log.Println("Ошибка обработки результата поиска:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка поиска сообщений"})
+			return
+		}
+		hits = append(hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка поиска сообщений:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка поиска сообщений"})
+		return
+	}
+
+	hasMore := len(hits) > limit
+	if hasMore {
+		hits = hits[:limit]
+	}
+
+	results, err := groupSearchHits(hits, userID, contextSize)
+	if err != nil {
+		log.Println("Ошибка получения результатов поиска:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка поиска сообщений"})
+		return
+	}
+
+	c.Header("X-Has-More", strconv.FormatBool(hasMore))
+	c.JSON(http.StatusOK, results)
+}
+
+// groupSearchHits раскладывает найденные сообщения по чатам в порядке первого
+// появления и дополняет их контекстом, вложениями и данными чатов.
+func groupSearchHits(hits []SearchHit, userID string, contextSize int) ([]ChatSearchResult, error) {
+	results := []ChatSearchResult{}
+	if len(hits) == 0 {
+		return results, nil
+	}
+
+	messages := make([]Message, len(hits))
+	for i := range hits {
+		messages[i] = hits[i].Message
+	}
+	if err := attachAttachments(messages); err != nil {
+		return nil, err
+	}
+	for i := range hits {
+		hits[i].Message = messages[i]
+	}
+	if err := attachSearchContext(hits, userID, contextSize); err != nil {
+		return nil, err
+	}
+
+	index := map[string]int{}
+	var chatIDs []string
+	for _, h := range hits {
+		i, ok := index[h.Message.ChatID]
+		if !ok {
+			i = len(results)
+			index[h.Message.ChatID] = i
+			chatIDs = append(chatIDs, h.Message.ChatID)
+			results = append(results, ChatSearchResult{ChatID: h.Message.ChatID})
+		}
+		results[i].Hits = append(results[i].Hits, h)
+	}
+
+	rows, err := db.Query("SELECT id, kind, title, apartment_id, order_id FROM chats WHERE id = ANY($1::uuid[])", pq.Array(chatIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var chat ChatSearchResult
+		var title sql.NullString
+		var apartmentID, orderID sql.NullInt64
+		if err := rows.Scan(&id, &chat.Kind, &title, &apartmentID, &orderID); err != nil {
+			return nil, err
+		}
+		r := &results[index[id]]
+		r.Kind = chat.Kind
+		r.Title = nullStringPtr(title)
+		r.ApartmentID = nullIntPtr(apartmentID)
+		r.OrderID = nullIntPtr(orderID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := chatParticipants(chatIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Participants = members[results[i].ChatID]
+	}
+	return results, nil
+}
+
+// attachSearchContext загружает одним запросом по contextSize сообщений до и после
+// каждого найденного. Скрытые пользователем сообщения в контекст не попадают,
+// поэтому соседей может оказаться меньше.
+func attachSearchContext(hits []SearchHit, userID string, contextSize int) error {
+	for i := range hits {
+		hits[i].Before, hits[i].After = []Message{}, []Message{}
+	}
+	if contextSize == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(hits))
+	chatIDs := make([]string, len(hits))
+	seqs := make([]int64, len(hits))
+	position := map[string]int{}
+	for i, h := range hits {
+		ids[i], chatIDs[i], seqs[i] = h.Message.ID, h.Message.ChatID, h.Message.Seq
+		position[h.Message.ID] = i
+	}
+
+	rows, err := db.Query(`
+		SELECT `+messageColumns+`, h.hit_id
+		FROM messages
+		JOIN unnest($1::uuid[], $2::uuid[], $3::bigint[]) AS h(hit_id, hit_chat_id, hit_seq)
+		  ON chat_id = h.hit_chat_id AND seq BETWEEN h.hit_seq - $4 AND h.hit_seq + $4 AND seq <> h.hit_seq
+		WHERE NOT EXISTS (SELECT 1 FROM message_hidden mh WHERE mh.message_id = messages.id AND mh.user_id = $5)
+		ORDER BY h.hit_id, seq
+	`, pq.Array(ids), pq.Array(chatIDs), pq.Array(seqs), contextSize, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m Message
+		var hitID string
+		if err := scanMessage(rows, &m, &hitID); err != nil {
+			return err
+		}
+		h := &hits[position[hitID]]
+		if m.Seq < h.Message.Seq {
+			h.Before = append(h.Before, m)
+		} else {
+			h.After = append(h.After, m)
+		}
+	}
+	return rows.Err()
+}
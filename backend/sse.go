@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sseHeartbeat  = 25 * time.Second
+	sseReplayPage = 500
+)
+
+// GET /events — поток SSE для сетей, где WebSocket заблокирован.
+// Отдает те же события, что и /ws. Переподключившийся клиент присылает
+// Last-Event-ID (или параметр last_event_id) и сначала получает все пропущенное.
+func eventsStreamHandler(c *gin.Context) {
+	userID := currentUserID(c)
+
+	lastID := int64(0)
+	lastHeader := c.GetHeader("Last-Event-ID")
+	if lastHeader == "" {
+		lastHeader = c.Query("last_event_id")
+	}
+	if lastHeader != "" {
+		id, err := strconv.ParseInt(lastHeader, 10, 64)
+		if err != nil || id < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный Last-Event-ID"})
+			return
+		}
+		lastID = id
+	}
+
+	// Подписываемся до чтения журнала, чтобы не потерять события между ними
+	client := hub.subscribe(userID)
+	defer hub.unsubscribe(client)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	// replayed — последний номер, отправленный из журнала. Живые события
+	// могут приходить не по порядку номеров (журнал пишут разные запросы
+	// параллельно), поэтому граница сдвигается только журналом
+	replayed := int64(0)
+	if lastHeader != "" {
+		var err error
+		if replayed, err = replayEvents(c.Writer, userID, lastID); err != nil {
+			log.Println("Ошибка чтения журнала событий:", err)
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case e, ok := <-client.send:
+			if !ok {
+				return
+			}
+			// Событие уже могло прийти из журнала
+			if e.ID != 0 && e.ID <= replayed {
+				continue
+			}
+			if err := writeSSEEvent(c.Writer, e); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-heartbeat.C:
+			if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// replayEvents отправляет события пользователя из журнала с номером больше afterID
+// и возвращает номер последнего отправленного.
+func replayEvents(w io.Writer, userID string, afterID int64) (int64, error) {
+	for {
+		rows, err := db.Query(`
+			SELECT id, type, COALESCE(chat_id::text, ''), payload
+			FROM realtime_events
+			WHERE recipients @> ARRAY[$1::uuid] AND id > $2
+			ORDER BY id
+			LIMIT $3
+		`, userID, afterID, sseReplayPage)
+		if err != nil {
+			return afterID, err
+		}
+
+		count := 0
+		for rows.Next() {
+			var e Event
+			var payload []byte
+			if err := rows.Scan(&e.ID, &e.Type, &e.ChatID, &payload); err != nil {
+				rows.Close()
+				return afterID, err
+			}
+			e.Payload = json.RawMessage(payload)
+			if err := writeSSEEvent(w, e); err != nil {
+				rows.Close()
+				return afterID, err
+			}
+			afterID = e.ID
+			count++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return afterID, err
+		}
+		if count < sseReplayPage {
+			return afterID, nil
+		}
+	}
+}
+
+func writeSSEEvent(w io.Writer, e Event) error {
+	event := sse.Event{
+		Event: e.Type,
+		Data:  clientEvent{ID: e.ID, Type: e.Type, ChatID: e.ChatID, Payload: e.Payload},
+	}
+	if e.ID != 0 {
+		event.Id = strconv.FormatInt(e.ID, 10)
+	}
+	return sse.Encode(w, event)
+}
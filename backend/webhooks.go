@@ -0,0 +1,821 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Статусы доставки
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead" // попытки кончились, доставка попала в список недоставленных
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	// Между попытками 30 с, 1 мин, 2 мин... но не больше webhookMaxBackoff.
+	// После webhookMaxAttempts неудач доставка считается недоставленной
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	webhookMaxAttempts = 10
+	// Пока попытка идет, доставка отложена на это время, чтобы ее не взял другой узел
+	webhookLease       = time.Minute
+	webhookConcurrency = 20 // одновременных доставок на узел
+	// Сколько хранятся завершенные доставки и их журнал
+	webhookLogRetention = 30 * 24 * time.Hour
+)
+
+type WebhookEndpoint struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Scope     string    `json:"scope"`
+	Active    bool      `json:"active"`
+	Secret    string    `json:"secret,omitempty"` // показывается только при создании
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const webhookEndpointColumns = "id, url, events, scope, active, created_at, updated_at"
+
+func scanWebhookEndpoint(row rowScanner, e *WebhookEndpoint) error {
+	return row.Scan(&e.ID, &e.URL, pq.Array(&e.Events), &e.Scope, &e.Active, &e.CreatedAt, &e.UpdatedAt)
+}
+
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	EndpointID     string          `json:"endpoint_id"`
+	EventID        int64           `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	ReplayOf       *int64          `json:"replay_of"`
+	CreatedAt      time.Time       `json:"created_at"`
+	FinishedAt     *time.Time      `json:"finished_at"`
+	LastStatusCode *int            `json:"last_status_code"`
+	LastError      *string         `json:"last_error"`
+}
+
+// Последняя попытка берется из журнала
+const webhookDeliveryColumns = `d.id, d.endpoint_id, d.event_id, d.event_type, d.payload, d.status, d.attempts,
+	d.next_attempt_at, d.replay_of, d.created_at, d.finished_at, la.status_code, la.error`
+
+const webhookDeliveryFrom = `
+	FROM webhook_deliveries d
+	JOIN webhook_endpoints e ON e.id = d.endpoint_id
+	LEFT JOIN LATERAL (
+		SELECT status_code, error FROM webhook_attempts a WHERE a.delivery_id = d.id ORDER BY a.id DESC LIMIT 1
+	) la ON true`
+
+func scanWebhookDelivery(row rowScanner, d *WebhookDelivery) error {
+	var payload []byte
+	var next, finished sql.NullTime
+	var replayOf, code sql.NullInt64
+	var lastError sql.NullString
+	err := row.Scan(&d.ID, &d.EndpointID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+		&next, &replayOf, &d.CreatedAt, &finished, &code, &lastError)
+	if err != nil {
+		return err
+	}
+	d.Payload = json.RawMessage(payload)
+	d.NextAttemptAt, d.FinishedAt, d.ReplayOf, d.LastStatusCode = nil, nil, nil, nil
+	if next.Valid && d.Status == deliveryPending {
+		d.NextAttemptAt = &next.Time
+	}
+	if finished.Valid {
+		d.FinishedAt = &finished.Time
+	}
+	if replayOf.Valid {
+		d.ReplayOf = &replayOf.Int64
+	}
+	if code.Valid {
+		c := int(code.Int64)
+		d.LastStatusCode = &c
+	}
+	d.LastError = nullStringPtr(lastError)
+	return nil
+}
+
+type WebhookAttempt struct {
+	ID          int64     `json:"id"`
+	AttemptedAt time.Time `json:"attempted_at"`
+	StatusCode  *int      `json:"status_code"`
+	Error       *string   `json:"error"`
+	DurationMS  int       `json:"duration_ms"`
+}
+
+// webhookSignature — подпись тела запроса: HMAC-SHA256 от "timestamp.body"
+// в hex. Метка времени в подписи не дает повторить старый запрос.
+func webhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// webhookBackoff — пауза перед следующей попыткой после attempts неудачных,
+// с разбросом до 10%, чтобы повторы к одному партнеру не шли пачкой.
+func webhookBackoff(attempts int) time.Duration {
+	d := time.Duration(float64(webhookBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if d > webhookMaxBackoff || d <= 0 {
+		d = webhookMaxBackoff
+	}
+	return d + time.Duration(mathrand.Int64N(int64(d/10)+1))
+}
+
+// Адреса, куда вебхуки не ходят: иначе через них можно было бы обращаться
+// к внутренней сети и метаданным облака от имени сервера
+var webhookBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // CGNAT
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64 — тот же IPv4 внутри
+}
+
+var errWebhookAddressBlocked = errors.New("адрес во внутренней сети")
+
+// webhookAddressAllowed — можно ли отправлять вебхуки на этот IP.
+func webhookAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() {
+		return false
+	}
+	for _, p := range webhookBlockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookHost проверяет все адреса, в которые разрешается имя хоста.
+func checkWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !webhookAddressAllowed(addr) {
+			return errWebhookAddressBlocked
+		}
+	}
+	return nil
+}
+
+// webhookDialer проверяет адрес уже после разрешения имени, прямо перед
+// соединением: имя, которое при регистрации указывало наружу, могли
+// перенаправить во внутреннюю сеть
+var webhookDialer = &net.Dialer{
+	Timeout: webhookTimeout,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil || !webhookAddressAllowed(addrPort.Addr()) {
+			return errWebhookAddressBlocked
+		}
+		return nil
+	},
+}
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	// Без прокси из окружения: иначе проверялся бы адрес прокси, а не партнера
+	Transport: &http.Transport{
+		DialContext:           webhookDialer.DialContext,
+		TLSHandshakeTimeout:   webhookTimeout,
+		ResponseHeaderTimeout: webhookTimeout,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	// Партнер должен отвечать сам, а не отправлять нас по другому адресу
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// webhookErrorText — описание неудачной попытки для журнала. Партнер видит журнал,
+// поэтому текст ошибки соединения не передается как есть: по нему можно было бы
+// выяснять, что происходит на чужих адресах.
+func webhookErrorText(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errWebhookAddressBlocked):
+		return "адрес во внутренней сети запрещен"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "истекло время ожидания ответа"
+	default:
+		return "не удалось доставить запрос"
+	}
+}
+
+type dueDelivery struct {
+	id        int64
+	eventID   int64
+	eventType string
+	payload   json.RawMessage
+	createdAt time.Time
+	attempts  int
+	url       string
+	secret    string
+}
+
+type webhookDeliveryArgs struct {
+	DeliveryID int64 `json:"delivery_id"`
+}
+
+var webhookDeliveryJob jobKind[webhookDeliveryArgs]
+
+func init() {
+	// Обработчик сам ставит следующую попытку, поэтому вид задачи
+	// регистрируется здесь, а не при объявлении переменной.
+	// Попытки и паузы между ними доставка считает сама, и задача
+	// повторяется только при ошибках базы
+	webhookDeliveryJob = defineJob("webhook.deliver", jobOptions{
+		MaxAttempts: 3,
+		Timeout:     webhookTimeout + 20*time.Second,
+		Concurrency: webhookConcurrency,
+	}, deliverWebhook)
+}
+
+// scheduleWebhookDelivery ставит попытку доставки на время at (пустое — сразу).
+func scheduleWebhookDelivery(q querier, deliveryID int64, at time.Time) error {
+	return webhookDeliveryJob.enqueue(q, webhookDeliveryArgs{DeliveryID: deliveryID},
+		enqueueOptions{RunAt: at, UniqueKey: strconv.FormatInt(deliveryID, 10)})
+}
+
+// deliverWebhook делает очередную попытку доставки, если ей пора.
+func deliverWebhook(ctx context.Context, args webhookDeliveryArgs) error {
+	var d dueDelivery
+	var payload []byte
+	err := db.QueryRowContext(ctx, `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = now() + make_interval(secs => $2), attempts = d.attempts + 1
+		FROM webhook_endpoints e
+		WHERE d.id = $1 AND e.id = d.endpoint_id
+		  AND d.status = 'pending' AND d.next_attempt_at <= now() AND e.active
+		RETURNING d.id, d.event_id, d.event_type, d.payload, d.event_created_at, d.attempts, e.url, e.secret
+	`, args.DeliveryID, webhookLease.Seconds()).Scan(&d.id, &d.eventID, &d.eventType, &payload, &d.createdAt, &d.attempts, &d.url, &d.secret)
+	if err == sql.ErrNoRows {
+		// Доставка уже завершена, адрес выключен или попытку сейчас делает другой узел.
+		// В последнем случае проверим еще раз, когда истечет его время
+		var next time.Time
+		err = db.QueryRowContext(ctx, `
+			SELECT d.next_attempt_at
+			FROM webhook_deliveries d JOIN webhook_endpoints e ON e.id = d.endpoint_id
+			WHERE d.id = $1 AND d.status = 'pending' AND e.active
+		`, args.DeliveryID).Scan(&next)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return scheduleWebhookDelivery(db, args.DeliveryID, next)
+	} else if err != nil {
+		return err
+	}
+	d.payload = json.RawMessage(payload)
+	return attemptWebhook(ctx, d)
+}
+
+// attemptWebhook отправляет одну доставку и записывает результат.
+// Успехом считается любой ответ 2xx; после неудачи ставится следующая попытка.
+func attemptWebhook(ctx context.Context, d dueDelivery) error {
+	body, err := json.Marshal(gin.H{
+		"id":         d.eventID,
+		"type":       d.eventType,
+		"created_at": d.createdAt,
+		"data":       d.payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	var statusCode sql.NullInt64
+	var errText sql.NullString
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err == nil {
+		timestamp := started.Unix()
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "apartments-webhooks/1")
+		req.Header.Set("X-Webhook-Event", d.eventType)
+		req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.id, 10))
+		req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+		req.Header.Set("X-Webhook-Signature", webhookSignature(d.secret, timestamp, body))
+
+		// Тело ответа не сохраняется: в журнале только код
+		var resp *http.Response
+		if resp, err = webhookClient.Do(req); err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			statusCode = sql.NullInt64{Int64: int64(resp.StatusCode), Valid: true}
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("ответ %d", resp.StatusCode)
+			}
+		} else {
+			log.Printf("Ошибка доставки вебхука #%d: %v", d.id, err)
+			err = errors.New(webhookErrorText(err))
+		}
+	}
+	if err != nil {
+		errText = sql.NullString{String: err.Error(), Valid: true}
+	}
+	duration := time.Since(started).Milliseconds()
+
+	status, next := deliveryDelivered, time.Now()
+	if err != nil {
+		status = deliveryPending
+		next = next.Add(webhookBackoff(d.attempts))
+		if d.attempts >= webhookMaxAttempts {
+			status = deliveryDead
+		}
+	}
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	_, txErr = tx.Exec(`
+		INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms)
+		VALUES ($1, $2, $3, $4)
+	`, d.id, statusCode, errText, duration)
+	if txErr == nil {
+		_, txErr = tx.Exec(`
+			UPDATE webhook_deliveries
+			SET status = $2, next_attempt_at = $3,
+			    finished_at = CASE WHEN $2 = 'pending' THEN NULL ELSE now() END
+			WHERE id = $1
+		`, d.id, status, next)
+	}
+	if txErr == nil && status == deliveryPending {
+		txErr = scheduleWebhookDelivery(tx, d.id, next)
+	}
+	if txErr == nil {
+		txErr = tx.Commit()
+	}
+	return txErr
+}
+
+// cleanupWebhookLog удаляет завершенные доставки старше webhookLogRetention
+// вместе с журналом попыток и разосланные события outbox старше outboxRetention.
+func cleanupWebhookLog() (int64, error) {
+	result, err := db.Exec(`
+		DELETE FROM webhook_deliveries
+		WHERE status <> 'pending' AND finished_at < now() - make_interval(secs => $1)
+	`, webhookLogRetention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	deliveries, _ := result.RowsAffected()
+	result, err = db.Exec("DELETE FROM outbox WHERE dispatched_at < now() - make_interval(secs => $1)", outboxRetention.Seconds())
+	if err != nil {
+		return deliveries, err
+	}
+	events, _ := result.RowsAffected()
+	return deliveries + events, nil
+}
+
+type webhookEndpointRequest struct {
+	URL    *string  `json:"url"`
+	Events []string `json:"events"`
+	Scope  *string  `json:"scope"`
+	Active *bool    `json:"active"`
+}
+
+// validate проверяет переданные поля. Ошибка — текст для ответа 400.
+func (r webhookEndpointRequest) validate(c *gin.Context) string {
+	if r.URL != nil {
+		u, err := url.Parse(*r.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" || len(*r.URL) > 2000 {
+			return "url должен быть абсолютным адресом http или https"
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+		err = checkWebhookHost(ctx, u.Hostname())
+		cancel()
+		if errors.Is(err, errWebhookAddressBlocked) {
+			return "url не может указывать на внутреннюю сеть"
+		} else if err != nil {
+			return "Не удалось найти хост из url"
+		}
+	}
+	if r.Events != nil {
+		if len(r.Events) == 0 {
+			return "Нужно подписаться хотя бы на одно событие"
+		}
+		for _, e := range r.Events {
+			if !slices.Contains(outboxEventTypes, e) {
+				return fmt.Sprintf("Неизвестное событие %q", e)
+			}
+		}
+	}
+	if r.Scope != nil {
+		switch *r.Scope {
+		case "own":
+		case "all":
+			if c.GetString("role") != "admin" {
+				return "Получать все события может только администратор"
+			}
+		default:
+			return "scope должен быть own или all"
+		}
+	}
+	return ""
+}
+
+// GET /webhooks — адреса текущего партнера
+func getWebhookEndpointsHandler(c *gin.Context) {
+	rows, err := db.Query("SELECT "+webhookEndpointColumns+" FROM webhook_endpoints WHERE owner_id = $1 ORDER BY created_at", currentUserID(c))
+	if err != nil {
+		log.Println("Ошибка получения вебхуков:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения вебхуков"})
+		return
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		var e WebhookEndpoint
+		if err := scanWebhookEndpoint(rows, &e); err != nil {
+			log.Println("Ошибка обработки вебхука:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения вебхуков"})
+			return
+		}
+		endpoints = append(endpoints, e)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка получения вебхуков:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения вебхуков"})
+		return
+	}
+
+	c.JSON(http.StatusOK, endpoints)
+}
+
+// POST /webhooks — зарегистрировать адрес. Секрет для проверки подписи
+// возвращается только в этом ответе.
+func createWebhookEndpointHandler(c *gin.Context) {
+	var request webhookEndpointRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	if request.URL == nil || request.Events == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Нужно указать url и events"})
+		return
+	}
+	if msg := request.validate(c); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	scope := "own"
+	if request.Scope != nil {
+		scope = *request.Scope
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		log.Println("Ошибка создания секрета:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания вебхука"})
+		return
+	}
+
+	var e WebhookEndpoint
+	err = scanWebhookEndpoint(db.QueryRow(`
+		INSERT INTO webhook_endpoints (id, owner_id, url, secret, events, scope)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+webhookEndpointColumns,
+		uuid.New().String(), currentUserID(c), *request.URL, secret, pq.Array(request.Events), scope), &e)
+	if err != nil {
+		log.Println("Ошибка создания вебхука:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка создания вебхука"})
+		return
+	}
+	e.Secret = secret
+
+	c.JSON(http.StatusCreated, e)
+}
+
+// PATCH /webhooks/:id — изменить адрес, подписки или выключить его.
+func updateWebhookEndpointHandler(c *gin.Context) {
+	var request webhookEndpointRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Некорректный формат JSON"})
+		return
+	}
+	if msg := request.validate(c); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Вебхук не найден"})
+		return
+	}
+	var events any
+	if request.Events != nil {
+		events = pq.Array(request.Events)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения вебхука"})
+		return
+	}
+	defer tx.Rollback()
+
+	var e WebhookEndpoint
+	err = scanWebhookEndpoint(tx.QueryRow(`
+		UPDATE webhook_endpoints
+		SET url = COALESCE($3, url), events = COALESCE($4::text[], events),
+		    scope = COALESCE($5, scope), active = COALESCE($6, active), updated_at = now()
+		WHERE id = $1 AND owner_id = $2
+		RETURNING `+webhookEndpointColumns,
+		id.String(), currentUserID(c), request.URL, events, request.Scope, request.Active), &e)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Вебхук не найден"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка изменения вебхука:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения вебхука"})
+		return
+	}
+
+	// Пока адрес был выключен, доставки к нему копились; теперь их пора отправить
+	if request.Active != nil && *request.Active {
+		if err := resumeWebhookDeliveries(tx, e.ID); err != nil {
+			log.Println("Ошибка постановки доставок:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения вебхука"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Ошибка изменения вебхука:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка изменения вебхука"})
+		return
+	}
+
+	c.JSON(http.StatusOK, e)
+}
+
+// resumeWebhookDeliveries ставит в очередь все ожидающие доставки адреса.
+func resumeWebhookDeliveries(tx *sql.Tx, endpointID string) error {
+	rows, err := tx.Query("SELECT id, next_attempt_at FROM webhook_deliveries WHERE endpoint_id = $1 AND status = 'pending'", endpointID)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id   int64
+		next time.Time
+	}
+	var deliveries []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.next); err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range deliveries {
+		if err := scheduleWebhookDelivery(tx, p.id, p.next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DELETE /webhooks/:id — удалить адрес вместе с журналом доставок
+func deleteWebhookEndpointHandler(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Вебхук не найден"})
+		return
+	}
+	res, err := db.Exec("DELETE FROM webhook_endpoints WHERE id = $1 AND owner_id = $2", id.String(), currentUserID(c))
+	if err != nil {
+		log.Println("Ошибка удаления вебхука:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка удаления вебхука"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Вебхук не найден"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// listWebhookDeliveries отдает доставки партнера, новые первыми, с X-Has-More.
+func listWebhookDeliveries(c *gin.Context, where string, args ...any) {
+	limit, offset, ok := pageParams(c, 50, 200)
+	if !ok {
+		return
+	}
+	args = append([]any{currentUserID(c), limit + 1, offset}, args...)
+
+	rows, err := db.Query(`
+		SELECT `+webhookDeliveryColumns+webhookDeliveryFrom+`
+		WHERE e.owner_id = $1 AND `+where+`
+		ORDER BY d.id DESC
+		LIMIT $2 OFFSET $3
+	`, args...)
+	if err != nil {
+		log.Println("Ошибка получения доставок вебхуков:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения доставок"})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := scanWebhookDelivery(rows, &d); err != nil {
+			log.Println("Ошибка обработки доставки вебхука:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения доставок"})
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка получения доставок вебхуков:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения доставок"})
+		return
+	}
+
+	hasMore := len(deliveries) > limit
+	if hasMore {
+		deliveries = deliveries[:limit]
+	}
+	c.Header("X-Has-More", strconv.FormatBool(hasMore))
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// GET /webhooks/:id/deliveries?status=&limit=&offset= — журнал доставок адреса
+func getWebhookDeliveriesHandler(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Вебхук не найден"})
+		return
+	}
+	status := c.Query("status")
+	if status != "" && status != deliveryPending && status != deliveryDelivered && status != deliveryDead {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status должен быть pending, delivered или dead"})
+		return
+	}
+	listWebhookDeliveries(c, "d.endpoint_id = $4 AND ($5 = '' OR d.status = $5)", id.String(), status)
+}
+
+// GET /webhooks/dead-letters — недоставленные события по всем адресам партнера
+func getWebhookDeadLettersHandler(c *gin.Context) {
+	listWebhookDeliveries(c, "d.status = 'dead'")
+}
+
+// GET /webhooks/deliveries/:delivery_id/attempts — все попытки одной доставки
+func getWebhookAttemptsHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("delivery_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Доставка не найдена"})
+		return
+	}
+
+	var owned bool
+	err = db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM webhook_deliveries d JOIN webhook_endpoints e ON e.id = d.endpoint_id
+		               WHERE d.id = $1 AND e.owner_id = $2)
+	`, id, currentUserID(c)).Scan(&owned)
+	if err != nil {
+		log.Println("Ошибка получения доставки вебхука:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения попыток доставки"})
+		return
+	}
+	if !owned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Доставка не найдена"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, attempted_at, status_code, error, duration_ms
+		FROM webhook_attempts WHERE delivery_id = $1 ORDER BY id
+	`, id)
+	if err != nil {
+		log.Println("Ошибка получения попыток доставки:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения попыток доставки"})
+		return
+	}
+	defer rows.Close()
+
+	attempts := []WebhookAttempt{}
+	for rows.Next() {
+		var a WebhookAttempt
+		var code sql.NullInt64
+		var errText sql.NullString
+		if err := rows.Scan(&a.ID, &a.AttemptedAt, &code, &errText, &a.DurationMS); err != nil {
+			log.Println("Ошибка обработки попытки доставки:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения попыток доставки"})
+			return
+		}
+		if code.Valid {
+			v := int(code.Int64)
+			a.StatusCode = &v
+		}
+		a.Error = nullStringPtr(errText)
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Ошибка получения попыток доставки:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения попыток доставки"})
+		return
+	}
+
+	c.JSON(http.StatusOK, attempts)
+}
+
+// POST /webhooks/deliveries/:delivery_id/replay — отправить событие еще раз.
+// Создается новая доставка с тем же id события, чтобы партнер мог отсеять дубли.
+func replayWebhookDeliveryHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("delivery_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Доставка не найдена"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка повтора доставки"})
+		return
+	}
+	defer tx.Rollback()
+
+	var newID int64
+	err = tx.QueryRow(`
+		INSERT INTO webhook_deliveries (endpoint_id, event_id, event_type, payload, event_created_at, replay_of)
+		SELECT d.endpoint_id, d.event_id, d.event_type, d.payload, d.event_created_at, d.id
+		FROM webhook_deliveries d
+		JOIN webhook_endpoints e ON e.id = d.endpoint_id
+		WHERE d.id = $1 AND e.owner_id = $2
+		RETURNING id
+	`, id, currentUserID(c)).Scan(&newID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Доставка не найдена"})
+		return
+	} else if err != nil {
+		log.Println("Ошибка повтора доставки:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка повтора доставки"})
+		return
+	}
+	if err := scheduleWebhookDelivery(tx, newID, time.Time{}); err != nil {
+		log.Println("Ошибка постановки доставки:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка повтора доставки"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Ошибка повтора доставки:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка повтора доставки"})
+		return
+	}
+
+	var d WebhookDelivery
+	if err := scanWebhookDelivery(db.QueryRow("SELECT "+webhookDeliveryColumns+webhookDeliveryFrom+" WHERE d.id = $1", newID), &d); err != nil {
+		log.Println("Ошибка получения доставки вебхука:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка повтора доставки"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, d)
+}
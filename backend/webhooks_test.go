@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:4700::6810:85e5": true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"::1":                  false,
+		"::":                   false,
+		"fe80::1":              false,
+		"fd00::1":              false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:10.0.0.1":      false,
+		"64:ff9b::a00:1":       false,
+		"224.0.0.1":            false,
+	} {
+		if got := webhookAddressAllowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("webhookAddressAllowed(%s) = %v, нужно %v", addr, got, want)
+		}
+	}
+}
+
+// Даже если имя разрешилось во внутренний адрес уже после регистрации,
+// соединение не устанавливается, а в журнал не попадает ничего об адресе.
+func TestWebhookClientRefusesInternalAddress(t *testing.T) {
+	reached := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer server.Close()
+
+	resp, err := webhookClient.Post(server.URL, "application/json", strings.NewReader("{}"))
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("запрос на 127.0.0.1 должен быть отклонен")
+	}
+	if reached {
+		t.Fatal("запрос дошел до внутреннего адреса")
+	}
+	text := webhookErrorText(err)
+	if text != "адрес во внутренней сети запрещен" || strings.Contains(text, "127.0.0.1") {
+		t.Errorf("текст ошибки = %q", text)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Авторизация идет по токену, а не по cookie, поэтому чужой Origin не опасен
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// То, что видит клиент: без списка получателей
+type clientEvent struct {
+	ID      int64  `json:"id,omitempty"`
+	Type    string `json:"type"`
+	ChatID  string `json:"chat_id,omitempty"`
+	Payload any    `json:"payload"`
+}
+
+// GET /ws — события по всем чатам авторизованного пользователя.
+// Токен передается в заголовке Authorization или в параметре access_token.
+func websocketHandler(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("Ошибка установки WebSocket-соединения:", err)
+		return
+	}
+
+	client := hub.subscribe(currentUserID(c))
+	go wsWritePump(conn, client)
+	wsReadPump(conn, client)
+}
+
+// wsReadPump держит соединение живым и замечает, что клиент ушел.
+// Сообщения от клиента не ожидаются: отправка идет через REST.
+func wsReadPump(conn *websocket.Conn, client *realtimeClient) {
+	defer func() {
+		hub.unsubscribe(client)
+		conn.Close()
+	}()
+
+	conn.SetReadLimit(4096)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("WebSocket закрыт с ошибкой:", err)
+			}
+			return
+		}
+	}
+}
+
+func wsWritePump(conn *websocket.Conn, client *realtimeClient) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case e, ok := <-client.send:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, ""))
+				return
+			}
+			if err := conn.WriteJSON(clientEvent{ID: e.ID, Type: e.Type, ChatID: e.ChatID, Payload: e.Payload}); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
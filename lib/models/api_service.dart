@@ -200,14 +200,13 @@ class ApiService {
   // Обновление информации о квартире
   Future<void> updateApartment(Note note) async {
     final data = {
-      "ID": note.id,
-      "Title": note.title,
-      "Description": note.description,
-      "ImageLink": note.photo_id,
-      "Price": note.price,
+      "title": note.title,
+      "description": note.description,
+      "image_link": note.photo_id,
+      "price": note.price,
     };
     try {
-      final response = await _dio.put('/apartments/update/${note.id}', data: data);
+      final response = await _dio.patch('/apartments/${note.id}', data: data);
       if (response.statusCode != 200) {
         throw Exception('Ошибка обновления информации о квартире');
       }